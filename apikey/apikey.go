@@ -0,0 +1,245 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrInvalidKey is returned for malformed, unknown or revoked keys
+	ErrInvalidKey = errors.New("invalid api key")
+	// ErrKeyExpired is returned for keys past their expiry
+	ErrKeyExpired = errors.New("api key has expired")
+)
+
+// Schema creates the table used by Repository
+const Schema = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id           TEXT PRIMARY KEY,
+	user_id      BIGINT NOT NULL,
+	name         TEXT NOT NULL,
+	key_hash     TEXT NOT NULL,
+	scopes       TEXT[] NOT NULL DEFAULT '{}',
+	expires_at   TIMESTAMPTZ,
+	last_used_at TIMESTAMPTZ,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+`
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Config controls key format and usage tracking
+type Config struct {
+	// Prefix starts every key so leaked keys are easy to recognise in code
+	// and logs. Defaults to "ak".
+	Prefix string `yaml:"prefix"`
+	// LastUsedInterval limits how often last_used_at is written for a busy
+	// key. Defaults to one minute.
+	LastUsedInterval time.Duration `yaml:"lastUsedInterval"`
+}
+
+// Key is an issued API key. The secret itself is never stored.
+type Key struct {
+	ID         string     `json:"id"`
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Repository issues API keys and stores their hashes in Postgres
+type Repository struct {
+	store datastore.Store
+	cfg   Config
+}
+
+// NewRepository creates a key repository on the store's connection
+func NewRepository(store datastore.Store, cfg Config) (*Repository, error) {
+	if store == nil || store.GetDB() == nil {
+		return nil, fmt.Errorf("invalid database connection")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "ak"
+	}
+	if cfg.LastUsedInterval <= 0 {
+		cfg.LastUsedInterval = time.Minute
+	}
+	return &Repository{store: store, cfg: cfg}, nil
+}
+
+// Issue creates a key for the user and returns it in plain text along with
+// its metadata. The plain text key cannot be recovered later. A nil
+// expiresAt makes a key that never expires.
+func (r *Repository) Issue(ctx context.Context, userID uint, name string, scopes []string, expiresAt *time.Time) (string, *Key, error) {
+	id, err := randomToken(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := fmt.Sprintf("%s_%s_%s", r.cfg.Prefix, id, secret)
+
+	if scopes == nil {
+		scopes = []string{}
+	}
+	key := &Key{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+
+	err = r.store.GetDB().QueryRowContext(ctx, `
+		INSERT INTO api_keys (id, user_id, name, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`,
+		id, userID, name, hashKey(plaintext), pq.Array(scopes), expiresAt,
+	).Scan(&key.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store api key: %w", err)
+	}
+
+	return plaintext, key, nil
+}
+
+// Authenticate looks up a plain text key and records its use
+func (r *Repository) Authenticate(ctx context.Context, plaintext string) (*Key, error) {
+	id, ok := r.parse(plaintext)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	key := &Key{ID: id}
+	var hash string
+	var revokedAt sql.NullTime
+	err := r.store.GetDB().QueryRowContext(ctx, `
+		SELECT user_id, name, key_hash, scopes, expires_at, last_used_at, created_at, revoked_at
+		FROM api_keys WHERE id = $1`, id,
+	).Scan(&key.UserID, &key.Name, &hash, pq.Array(&key.Scopes),
+		&key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashKey(plaintext))) != 1 || revokedAt.Valid {
+		return nil, ErrInvalidKey
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, ErrKeyExpired
+	}
+
+	if err := r.touch(ctx, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// touch updates last_used_at at most once per LastUsedInterval
+func (r *Repository) touch(ctx context.Context, key *Key) error {
+	now := time.Now()
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < r.cfg.LastUsedInterval {
+		return nil
+	}
+
+	_, err := r.store.GetDB().ExecContext(ctx,
+		`UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, now, key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record api key use: %w", err)
+	}
+	key.LastUsedAt = &now
+	return nil
+}
+
+// List returns the user's active keys, newest first
+func (r *Repository) List(ctx context.Context, userID uint) ([]*Key, error) {
+	rows, err := r.store.GetDB().QueryContext(ctx, `
+		SELECT id, name, scopes, expires_at, last_used_at, created_at
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*Key{}
+	for rows.Next() {
+		key := &Key{UserID: userID}
+		if err := rows.Scan(&key.ID, &key.Name, pq.Array(&key.Scopes),
+			&key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Revoke disables one of the user's keys
+func (r *Repository) Revoke(ctx context.Context, userID uint, id string) error {
+	result, err := r.store.GetDB().ExecContext(ctx, `
+		UPDATE api_keys SET revoked_at = now()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		id, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// parse splits <prefix>_<id>_<secret> and returns the id
+func (r *Repository) parse(plaintext string) (string, bool) {
+	rest, ok := strings.CutPrefix(plaintext, r.cfg.Prefix+"_")
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// hashKey hashes a plain text key. Keys carry 256 bits of randomness, so a
+// fast hash is enough to make a leaked table useless.
+func hashKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	return strings.ToLower(keyEncoding.EncodeToString(buf)), nil
+}
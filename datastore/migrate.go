@@ -0,0 +1,442 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrChecksumMismatch is returned when an applied migration's file has
+	// changed since it was applied
+	ErrChecksumMismatch = errors.New("migration checksum mismatch")
+	// ErrIrreversible is returned when rolling back a migration without a
+	// down script
+	ErrIrreversible = errors.New("migration has no down script")
+	// ErrLockTimeout is returned when another instance holds the migration
+	// lock for longer than the lock timeout
+	ErrLockTimeout = errors.New("timed out waiting for the migration lock")
+)
+
+// migrationLock is the advisory lock key migration runs hold, so that of
+// several instances starting together only one migrates
+const migrationLock int64 = 0x6170705f6d696772
+
+const (
+	defaultLockTimeout = 5 * time.Minute
+	lockPollInterval   = 500 * time.Millisecond
+)
+
+// migrationsTable records applied migrations
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version       BIGINT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	checksum      TEXT NOT NULL,
+	down_checksum TEXT NOT NULL DEFAULT '',
+	applied_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// migrationFile matches 0001_create_users.up.sql, 0001_create_users.down.sql
+// and 0001_create_users.sql, which is an up script
+var migrationFile = regexp.MustCompile(`^(\d+)_([^.]+?)(?:\.(up|down))?\.sql$`)
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// Checksum identifies the up script; an applied migration whose script
+	// changes is refused
+	Checksum string
+	// DownChecksum identifies the down script, or is empty without one. A
+	// migration is only rolled back with the down script it was applied with.
+	DownChecksum string
+}
+
+// AppliedMigration is a row of schema_migrations
+type AppliedMigration struct {
+	Version      int64
+	Name         string
+	Checksum     string
+	DownChecksum string
+}
+
+// LoadMigrations reads the migrations at the root of fsys, which may be an
+// embed.FS narrowed with fs.Sub or an os.DirFS. Files are named
+// <version>_<name>.up.sql with an optional <version>_<name>.down.sql.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "down" {
+			if m.Down != "" {
+				return nil, fmt.Errorf("migration %d has more than one down script", version)
+			}
+			m.Down = string(content)
+			m.DownChecksum = checksum(m.Down)
+			continue
+		}
+		if m.Up != "" {
+			return nil, fmt.Errorf("migration %d has more than one up script", version)
+		}
+		m.Up = string(content)
+		m.Checksum = checksum(m.Up)
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func checksum(script string) string {
+	// Line endings should not make a checked out file look modified
+	sum := sha256.Sum256([]byte(strings.ReplaceAll(script, "\r\n", "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// querier is implemented by *sql.DB and *sql.Conn
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Migrator applies and rolls back migrations, recording them in the
+// schema_migrations table. Up and Down hold a Postgres advisory lock, so
+// instances started together take turns and all but the first find
+// nothing left to do.
+type Migrator struct {
+	// LockTimeout is how long Up and Down wait for another instance to
+	// finish migrating. Defaults to five minutes.
+	LockTimeout time.Duration
+
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for migrations, as returned by
+// LoadMigrations
+func NewMigrator(db *sql.DB, migrations []Migration) (*Migrator, error) {
+	if db == nil {
+		return nil, fmt.Errorf("invalid database connection")
+	}
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return &Migrator{LockTimeout: defaultLockTimeout, db: db, migrations: sorted}, nil
+}
+
+// Applied returns the applied migrations in version order
+func (m *Migrator) Applied(ctx context.Context) ([]AppliedMigration, error) {
+	return m.applied(ctx, m.db)
+}
+
+// applied reads schema_migrations, which is created by the first Up or
+// Down. Until then no migrations have been applied.
+func (m *Migrator) applied(ctx context.Context, q querier) ([]AppliedMigration, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT version, name, checksum, down_checksum FROM schema_migrations ORDER BY version`)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" { // undefined_table
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var a AppliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.DownChecksum); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		applied = append(applied, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	return applied, nil
+}
+
+// Version returns the latest applied version, or 0 if none
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	return m.version(ctx, m.db)
+}
+
+func (m *Migrator) version(ctx context.Context, q querier) (int64, error) {
+	applied, err := m.applied(ctx, q)
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// Verify checks that every applied migration is still present unchanged
+// and returns the migrations still to apply
+func (m *Migrator) Verify(ctx context.Context) ([]Migration, error) {
+	return m.verify(ctx, m.db)
+}
+
+func (m *Migrator) verify(ctx context.Context, q querier) ([]Migration, error) {
+	applied, err := m.applied(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int64]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	done := make(map[int64]bool, len(applied))
+	var latest int64
+	for _, a := range applied {
+		migration, ok := known[a.Version]
+		if !ok {
+			return nil, fmt.Errorf("applied migration %d_%s is missing", a.Version, a.Name)
+		}
+		if migration.Checksum != a.Checksum {
+			return nil, fmt.Errorf("%w: %d_%s was modified after it was applied",
+				ErrChecksumMismatch, a.Version, a.Name)
+		}
+		done[a.Version] = true
+		latest = a.Version
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if done[migration.Version] {
+			continue
+		}
+		// Applying an older migration after newer ones could run it against
+		// a schema it was never written for
+		if migration.Version < latest {
+			return nil, fmt.Errorf("migration %d_%s is older than the applied version %d",
+				migration.Version, migration.Name, latest)
+		}
+		pending = append(pending, migration)
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order, each in its own
+// transaction, and returns how many were applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	var applied int
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		applied, err = m.up(ctx, conn)
+		return err
+	})
+	return applied, err
+}
+
+func (m *Migrator) up(ctx context.Context, q querier) (int, error) {
+	pending, err := m.verify(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		version, err := m.version(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		logger.Logger().Info("Schema is up to date", zap.Int64("version", version))
+		return 0, nil
+	}
+
+	for i, migration := range pending {
+		err := inTx(ctx, q, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, name, checksum, down_checksum) VALUES ($1, $2, $3, $4)`,
+				migration.Version, migration.Name, migration.Checksum, migration.DownChecksum)
+			return err
+		})
+		if err != nil {
+			return i, fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		logger.Logger().Info("Applied migration",
+			zap.Int64("version", migration.Version),
+			zap.String("name", migration.Name),
+		)
+	}
+	return len(pending), nil
+}
+
+// Down rolls back the latest steps migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		return m.down(ctx, conn, steps)
+	})
+}
+
+func (m *Migrator) down(ctx context.Context, q querier, steps int) error {
+	if _, err := m.verify(ctx, q); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int64]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	for i := 0; i < steps && i < len(applied); i++ {
+		a := applied[len(applied)-1-i]
+		migration := known[a.Version]
+		if migration.Down == "" {
+			return fmt.Errorf("%w: %d_%s", ErrIrreversible, migration.Version, migration.Name)
+		}
+		// The down script must undo what was applied, so it may not have
+		// changed either
+		if migration.DownChecksum != a.DownChecksum {
+			return fmt.Errorf("%w: the down script of %d_%s was modified after the migration was applied",
+				ErrChecksumMismatch, migration.Version, migration.Name)
+		}
+
+		err := inTx(ctx, q, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				`DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to roll back migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		logger.Logger().Info("Rolled back migration",
+			zap.Int64("version", migration.Version),
+			zap.String("name", migration.Name),
+		)
+	}
+	return nil
+}
+
+func inTx(ctx context.Context, q querier, fn func(tx *sql.Tx) error) error {
+	tx, err := q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// locked runs fn on a connection holding the migration lock, once
+// schema_migrations exists. The lock is tried repeatedly rather than waited
+// on so that the wait can time out.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for waiting := false; ; waiting = true {
+		var locked bool
+		err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLock).Scan(&locked)
+		if err != nil {
+			return fmt.Errorf("failed to take the migration lock: %w", err)
+		}
+		if locked {
+			break
+		}
+		if !waiting {
+			logger.Logger().Info("Waiting for another instance to finish migrating",
+				zap.Duration("timeout", timeout))
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	defer func() {
+		// The lock belongs to the session, so a connection that could not
+		// release it must not go back to the pool still holding it
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+		if err != nil {
+			logger.Logger().Error("Failed to release the migration lock", logger.WithError(err))
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, migrationsTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
@@ -0,0 +1,41 @@
+package datastore
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrationsChecksumsBothScripts(t *testing.T) {
+	load := func(down string) Migration {
+		t.Helper()
+		fsys := fstest.MapFS{
+			"0001_users.up.sql": {Data: []byte("CREATE TABLE users (id BIGINT);\n")},
+		}
+		if down != "" {
+			fsys["0001_users.down.sql"] = &fstest.MapFile{Data: []byte(down)}
+		}
+		migrations, err := LoadMigrations(fsys)
+		if err != nil {
+			t.Fatalf("LoadMigrations: %v", err)
+		}
+		return migrations[0]
+	}
+
+	irreversible := load("")
+	dropTable := load("DROP TABLE users;\n")
+	dropTableCRLF := load("DROP TABLE users;\r\n")
+	dropCascade := load("DROP TABLE users CASCADE;\n")
+
+	if irreversible.DownChecksum != "" {
+		t.Errorf("migration without down script has down checksum %q", irreversible.DownChecksum)
+	}
+	if dropTable.Checksum != irreversible.Checksum {
+		t.Error("down script changed the up checksum")
+	}
+	if dropTable.DownChecksum == "" || dropTable.DownChecksum != dropTableCRLF.DownChecksum {
+		t.Errorf("down checksums %q and %q", dropTable.DownChecksum, dropTableCRLF.DownChecksum)
+	}
+	if dropTable.DownChecksum == dropCascade.DownChecksum {
+		t.Error("modified down script has the same checksum")
+	}
+}
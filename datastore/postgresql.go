@@ -1,20 +1,74 @@
 package datastore
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// ErrUnreachable is wrapped by Connect errors that retrying may fix, such
+// as a database that is still starting. Any other error, like a modified
+// migration, needs an operator.
+var ErrUnreachable = errors.New("database is unreachable")
+
 type DBConfig struct {
+	// DSN is a full connection string, either key=value pairs or a
+	// postgres:// URL. When set it replaces Host, Port, User, Password and
+	// DBName; the settings below still apply on top of it.
+	DSN      string
 	Host     string
 	Port     int
 	User     string
 	Password string
 	DBName   string
-	Scripts  []string
+
+	// SSLMode is one of disable, require, verify-ca or verify-full.
+	// Defaults to disable unless DSN is set.
+	SSLMode string
+	// SSLRootCert is the CA certificate file the server is verified against
+	SSLRootCert string
+	// SSLCert and SSLKey are the client certificate and key files
+	SSLCert string
+	SSLKey  string
+	// ApplicationName is reported in pg_stat_activity
+	ApplicationName string
+	// StatementTimeout aborts statements running longer. Zero leaves the
+	// server default.
+	StatementTimeout time.Duration
+	// SearchPath is the comma separated schema search path
+	SearchPath string
+
+	// Pool settings; zero leaves the database/sql default. A negative
+	// MaxIdleConns keeps no idle connections.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Scripts are executed on every start, in order, without tracking.
+	//
+	// Deprecated: use Migrations.
+	Scripts []string
+	// Migrations holds numbered migrations, as read by LoadMigrations,
+	// which are applied on start
+	Migrations fs.FS
+	// MigrationLockTimeout is how long to wait for another instance that
+	// is running the scripts and migrations. Defaults to five minutes.
+	MigrationLockTimeout time.Duration
+
+	// Retry waits for a database that is still starting
+	Retry RetryConfig
 }
 
 type Store interface {
@@ -27,25 +81,136 @@ type DBStore struct {
 }
 
 func NewPostgresDB(cfg *DBConfig) (*DBStore, error) {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.DBName)
+	db, err := OpenPostgresDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Connect(context.Background(), cfg); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenPostgresDB prepares the connection pool without connecting, for
+// servers that start before the database is up. Connect before use.
+func OpenPostgresDB(cfg *DBConfig) (*DBStore, error) {
+	dsn, err := cfg.dataSourceName()
+	if err != nil {
+		return nil, err
+	}
 
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
+	if cfg.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+	if cfg.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	}
+
+	return &DBStore{DB: db}, nil
+}
 
-	if err = db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+// Connect waits for the database, retrying as configured by cfg.Retry, and
+// then runs the init scripts and migrations
+func (s *DBStore) Connect(ctx context.Context, cfg *DBConfig) error {
+	err := retry(ctx, cfg.Retry, "postgres", func(ctx context.Context) error {
+		return s.DB.PingContext(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to ping database: %w: %w", ErrUnreachable, err)
 	}
 
-	if len(cfg.Scripts) > 0 {
-		if err := runInitScripts(db, cfg.Scripts); err != nil {
-			return nil, fmt.Errorf("failed to run init scripts: %w", err)
+	if len(cfg.Scripts) > 0 || cfg.Migrations != nil {
+		err := migrate(ctx, s.DB, cfg)
+		if err != nil && isConnectionError(err) {
+			return fmt.Errorf("%w: %w", ErrUnreachable, err)
 		}
+		return err
 	}
+	return nil
+}
 
-	return &DBStore{DB: db}, nil
+// isConnectionError reports whether err came from losing or waiting for
+// the database rather than from the scripts or migrations themselves
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Connection exceptions, and the server shutting down or restarting
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+	return errors.Is(err, ErrLockTimeout) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
+
+// dataSourceName builds the key=value connection string for lib/pq
+func (cfg *DBConfig) dataSourceName() (string, error) {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(quoteDSNValue(value))
+	}
+
+	if cfg.DSN != "" {
+		dsn := cfg.DSN
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return "", fmt.Errorf("invalid database URL: %w", err)
+			}
+		}
+		b.WriteString(dsn)
+	} else {
+		add("host", cfg.Host)
+		if cfg.Port != 0 {
+			add("port", strconv.Itoa(cfg.Port))
+		}
+		add("user", cfg.User)
+		add("password", cfg.Password)
+		add("dbname", cfg.DBName)
+		if cfg.SSLMode == "" {
+			add("sslmode", "disable")
+		}
+	}
+
+	// Later settings override those in DSN
+	add("sslmode", cfg.SSLMode)
+	add("sslrootcert", cfg.SSLRootCert)
+	add("sslcert", cfg.SSLCert)
+	add("sslkey", cfg.SSLKey)
+	add("application_name", cfg.ApplicationName)
+	if cfg.StatementTimeout > 0 {
+		add("statement_timeout", strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10))
+	}
+	add("search_path", cfg.SearchPath)
+	return b.String(), nil
+}
+
+// quoteDSNValue quotes a connection string value so that spaces, quotes
+// and backslashes, as in passwords, survive parsing
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
 }
 
 func NewStore(dbStore *DBStore) (Store, error) {
@@ -70,7 +235,7 @@ func (s *DBStore) GetDB() *sql.DB {
 	return s.DB
 }
 
-func runInitScripts(db *sql.DB, scripts []string) error {
+func runInitScripts(ctx context.Context, q querier, scripts []string) error {
 	// Loop through each script and execute
 	for _, scriptPath := range scripts {
 		// Read the content of the init script file
@@ -80,7 +245,7 @@ func runInitScripts(db *sql.DB, scripts []string) error {
 		}
 
 		// Execute the script
-		_, err = db.Exec(string(scriptContent))
+		_, err = q.ExecContext(ctx, string(scriptContent))
 		if err != nil {
 			return fmt.Errorf("failed to execute init script %s: %w", scriptPath, err)
 		}
@@ -88,3 +253,36 @@ func runInitScripts(db *sql.DB, scripts []string) error {
 
 	return nil
 }
+
+// migrate runs the init scripts and applies the pending migrations under
+// the migration lock, so replicas starting together do not race
+func migrate(ctx context.Context, db *sql.DB, cfg *DBConfig) error {
+	var migrations []Migration
+	if cfg.Migrations != nil {
+		var err error
+		if migrations, err = LoadMigrations(cfg.Migrations); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+	}
+	migrator, err := NewMigrator(db, migrations)
+	if err != nil {
+		return err
+	}
+	if cfg.MigrationLockTimeout > 0 {
+		migrator.LockTimeout = cfg.MigrationLockTimeout
+	}
+
+	return migrator.locked(ctx, func(conn *sql.Conn) error {
+		if len(cfg.Scripts) > 0 {
+			if err := runInitScripts(ctx, conn, cfg.Scripts); err != nil {
+				return fmt.Errorf("failed to run init scripts: %w", err)
+			}
+		}
+		if cfg.Migrations != nil {
+			if _, err := migrator.up(ctx, conn); err != nil {
+				return fmt.Errorf("failed to run migrations: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -12,6 +12,8 @@ type RedisConfig struct {
 	Addr     string
 	Password string
 	DB       int
+	// Retry waits for a Redis that is still starting
+	Retry RetryConfig
 }
 
 type RedisClient struct {
@@ -19,19 +21,33 @@ type RedisClient struct {
 }
 
 func NewRedisClient(cfg *RedisConfig) (*RedisClient, error) {
+	client := OpenRedisClient(cfg)
+	if err := client.Connect(context.Background(), cfg); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// OpenRedisClient creates the client without connecting, for servers that
+// start before Redis is up. Connect before use.
+func OpenRedisClient(cfg *RedisConfig) *RedisClient {
 	client := redis.NewClient(&redis.Options{
 		Addr:     cfg.Addr,
 		Password: cfg.Password,
 		DB:       cfg.DB,
 	})
+	return &RedisClient{Client: client}
+}
 
-	ctx := context.Background()
-	_, err := client.Ping(ctx).Result()
+// Connect waits for Redis, retrying as configured by cfg.Retry
+func (r *RedisClient) Connect(ctx context.Context, cfg *RedisConfig) error {
+	err := retry(ctx, cfg.Retry, "redis", func(ctx context.Context) error {
+		return r.Client.Ping(ctx).Err()
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		return fmt.Errorf("failed to connect to redis: %w", err)
 	}
-
-	return &RedisClient{Client: client}, nil
+	return nil
 }
 
 func NewRedis(redisClient *RedisClient) (*RedisClient, error) {
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"go.uber.org/zap"
+)
+
+// RetryConfig controls how long connecting waits for a database or Redis
+// that is not up yet, such as while containers start in any order. The
+// zero value tries once.
+type RetryConfig struct {
+	// Timeout bounds the whole wait across attempts. Zero tries once.
+	Timeout time.Duration
+	// InitialInterval is the wait after the first failed attempt; it
+	// doubles after each further one. Defaults to 500ms.
+	InitialInterval time.Duration
+	// MaxInterval caps the wait between attempts. Defaults to 10s.
+	MaxInterval time.Duration
+}
+
+// retry calls attempt until it succeeds or cfg.Timeout runs out, backing
+// off exponentially with jitter in between
+func retry(ctx context.Context, cfg RetryConfig, dependency string, attempt func(ctx context.Context) error) error {
+	if cfg.Timeout <= 0 {
+		return attempt(ctx)
+	}
+	if cfg.InitialInterval <= 0 {
+		cfg.InitialInterval = 500 * time.Millisecond
+	}
+	if cfg.MaxInterval <= 0 {
+		cfg.MaxInterval = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	interval := cfg.InitialInterval
+	for n := 1; ; n++ {
+		err := attempt(ctx)
+		if err == nil {
+			if n > 1 {
+				logger.Logger().Info("Connected",
+					zap.String("dependency", dependency),
+					zap.Int("attempts", n),
+				)
+			}
+			return nil
+		}
+
+		// Wait between half and all of the interval so that replicas
+		// started together do not retry in lockstep
+		wait := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		if time.Until(deadline) < wait {
+			return fmt.Errorf("gave up after %d attempts: %w", n, err)
+		}
+		logger.Logger().Warn("Dependency not ready",
+			zap.String("dependency", dependency),
+			zap.Int("attempt", n),
+			zap.Duration("retry_in", wait),
+			logger.WithError(err),
+		)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", n, err)
+		}
+		if interval *= 2; interval > cfg.MaxInterval {
+			interval = cfg.MaxInterval
+		}
+	}
+}
@@ -17,6 +17,9 @@ import (
 
 var log *zap.Logger
 
+// requestFieldsKey is where AddRequestFields keeps fields for the request log
+const requestFieldsKey = "log_fields"
+
 func init() {
 	// Create logs directory if it doesn't exist
 	err := os.MkdirAll("logs", 0755)
@@ -139,6 +142,9 @@ func ZapLoggerMiddleware(log *zap.Logger) echo.MiddlewareFunc {
 				zap.Int("status", res.Status),
 				zap.Duration("latency", time.Since(start)),
 			}
+			if extra, ok := c.Get(requestFieldsKey).([]zap.Field); ok {
+				fields = append(fields, extra...)
+			}
 
 			if err != nil {
 				fields = append(fields, zap.Error(err))
@@ -222,6 +228,18 @@ func Error(msg string, fields ...zap.Field) error {
 	})
 }
 
+// AddRequestFields attaches fields to the log line ZapLoggerMiddleware
+// writes when the request completes
+func AddRequestFields(c echo.Context, fields ...zap.Field) {
+	existing, _ := c.Get(requestFieldsKey).([]zap.Field)
+	c.Set(requestFieldsKey, append(existing, fields...))
+}
+
+// SecurityEvent logs an authentication or authorization event for security monitoring
+func SecurityEvent(event string, fields ...zap.Field) {
+	log.Warn("Security event", append([]zap.Field{zap.String("security_event", event)}, fields...)...)
+}
+
 // Add this helper function for consistent error field creation
 func WithError(err error) zap.Field {
 	return zap.Error(err)
@@ -0,0 +1,282 @@
+package mfa
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/1827mk/app-server/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotEnrolled is returned for users without a confirmed TOTP secret
+	ErrNotEnrolled = errors.New("mfa is not enabled")
+	// ErrInvalidCode is returned for wrong, expired or already used codes
+	ErrInvalidCode = errors.New("invalid mfa code")
+)
+
+// Schema creates the tables used by Manager
+const Schema = `
+CREATE TABLE IF NOT EXISTS user_mfa (
+	user_id      BIGINT PRIMARY KEY,
+	secret       TEXT NOT NULL,
+	enabled      BOOLEAN NOT NULL DEFAULT false,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	confirmed_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	user_id   BIGINT NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at   TIMESTAMPTZ,
+	PRIMARY KEY (user_id, code_hash)
+);
+`
+
+// Config controls TOTP verification and recovery codes
+type Config struct {
+	TOTP TOTP `yaml:"totp"`
+	// RecoveryCodes is how many recovery codes are issued on enrollment
+	RecoveryCodes int `yaml:"recoveryCodes"`
+}
+
+// Enrollment is a TOTP secret waiting to be confirmed with a first code
+type Enrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI to render as a QR code
+	URI string `json:"uri"`
+}
+
+// Manager enrolls users in TOTP and verifies their second factor. Secrets
+// and recovery codes live in Postgres; used time steps live in Redis.
+type Manager struct {
+	store datastore.Store
+	rdb   *redis.Client
+	cfg   Config
+}
+
+// NewManager creates a manager; zero config fields take their defaults
+func NewManager(store datastore.Store, rdb *redis.Client, cfg Config) (*Manager, error) {
+	if store == nil || store.GetDB() == nil {
+		return nil, fmt.Errorf("invalid database connection")
+	}
+	if rdb == nil {
+		return nil, fmt.Errorf("invalid redis connection")
+	}
+
+	def := DefaultTOTP()
+	if cfg.TOTP.Algorithm == "" {
+		cfg.TOTP.Algorithm = def.Algorithm
+	}
+	if cfg.TOTP.Digits == 0 {
+		cfg.TOTP.Digits = def.Digits
+	}
+	// Shorter codes are too easy to guess, and the HOTP truncation yields
+	// at most ten digits of which the first is barely random
+	if cfg.TOTP.Digits < 6 || cfg.TOTP.Digits > 8 {
+		return nil, fmt.Errorf("totp digits must be between 6 and 8, got %d", cfg.TOTP.Digits)
+	}
+	if cfg.TOTP.Period < time.Second {
+		cfg.TOTP.Period = def.Period
+	}
+	if cfg.TOTP.Skew < 0 {
+		cfg.TOTP.Skew = 0
+	}
+	if cfg.RecoveryCodes <= 0 {
+		cfg.RecoveryCodes = 10
+	}
+
+	return &Manager{store: store, rdb: rdb, cfg: cfg}, nil
+}
+
+// Enroll starts TOTP enrollment with a new secret. The secret replaces any
+// earlier unconfirmed one, and only takes effect once Confirm succeeds.
+func (m *Manager) Enroll(ctx context.Context, userID uint, account string) (*Enrollment, error) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	// An enabled secret is never overwritten; disable MFA first
+	result, err := m.store.GetDB().ExecContext(ctx, `
+		INSERT INTO user_mfa (user_id, secret, enabled, created_at)
+		VALUES ($1, $2, false, now())
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = now()
+		WHERE user_mfa.enabled = false`,
+		userID, secret,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store totp secret: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("mfa is already enabled")
+	}
+
+	return &Enrollment{
+		Secret: secret,
+		URI:    m.cfg.TOTP.ProvisioningURI(account, secret),
+	}, nil
+}
+
+// Confirm completes enrollment with the first code from the user's
+// authenticator app and returns the user's recovery codes
+func (m *Manager) Confirm(ctx context.Context, userID uint, code string) ([]string, error) {
+	secret, enabled, err := m.secret(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, fmt.Errorf("mfa is already enabled")
+	}
+
+	if err := m.verifyTOTP(ctx, userID, secret, code); err != nil {
+		return nil, err
+	}
+
+	_, err = m.store.GetDB().ExecContext(ctx, `
+		UPDATE user_mfa SET enabled = true, confirmed_at = now()
+		WHERE user_id = $1 AND secret = $2`,
+		userID, secret,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable mfa: %w", err)
+	}
+
+	logger.SecurityEvent("mfa_enabled", zap.Uint("user_id", userID))
+	return m.RegenerateRecoveryCodes(ctx, userID)
+}
+
+// Enabled reports whether the user has confirmed TOTP enrollment
+func (m *Manager) Enabled(ctx context.Context, userID uint) (bool, error) {
+	_, enabled, err := m.secret(ctx, userID)
+	if errors.Is(err, ErrNotEnrolled) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Verify checks a TOTP code or, failing that, a recovery code. Each TOTP
+// code and each recovery code is accepted only once.
+func (m *Manager) Verify(ctx context.Context, userID uint, code string) error {
+	secret, enabled, err := m.secret(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrNotEnrolled
+	}
+
+	if m.isTOTPCode(code) {
+		return m.verifyTOTP(ctx, userID, secret, code)
+	}
+
+	ok, err := m.useRecoveryCode(ctx, userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	logger.SecurityEvent("mfa_recovery_code_used", zap.Uint("user_id", userID))
+	return nil
+}
+
+// Disable removes the user's TOTP secret and recovery codes
+func (m *Manager) Disable(ctx context.Context, userID uint) error {
+	tx, err := m.store.GetDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete totp secret: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to disable mfa: %w", err)
+	}
+
+	logger.SecurityEvent("mfa_disabled", zap.Uint("user_id", userID))
+	return nil
+}
+
+func (m *Manager) secret(ctx context.Context, userID uint) (string, bool, error) {
+	var secret string
+	var enabled bool
+	err := m.store.GetDB().QueryRowContext(ctx,
+		`SELECT secret, enabled FROM user_mfa WHERE user_id = $1`, userID,
+	).Scan(&secret, &enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, ErrNotEnrolled
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load totp secret: %w", err)
+	}
+	return secret, enabled, nil
+}
+
+// markStepUsedScript records the last accepted time step and refuses any
+// step at or before it, so a code cannot be replayed within its window.
+// KEYS: last used step
+// ARGV: step, ttl ms
+var markStepUsedScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[1]))
+if last and tonumber(ARGV[1]) <= last then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+func totpUsedKey(userID uint) string {
+	return fmt.Sprintf("mfa_totp_used:%d", userID)
+}
+
+func (m *Manager) verifyTOTP(ctx context.Context, userID uint, secret, code string) error {
+	step, ok, err := m.cfg.TOTP.Validate(secret, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// Remember the step for as long as it could still validate
+	ttl := m.cfg.TOTP.Period * time.Duration(2*m.cfg.TOTP.Skew+1)
+	fresh, err := markStepUsedScript.Run(ctx, m.rdb, []string{totpUsedKey(userID)},
+		step, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to record totp code: %w", err)
+	}
+	if fresh == 0 {
+		logger.SecurityEvent("mfa_code_replay", zap.Uint("user_id", userID))
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// isTOTPCode tells TOTP codes apart from recovery codes, which always
+// contain letters or a dash
+func (m *Manager) isTOTPCode(code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != m.cfg.TOTP.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
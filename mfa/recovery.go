@@ -0,0 +1,106 @@
+package mfa
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// recoveryAlphabet leaves out characters that are easily confused
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCodes returns n codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		var b strings.Builder
+		for j, c := range buf {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(recoveryAlphabet[int(c)%len(recoveryAlphabet)])
+		}
+		codes[i] = b.String()
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code. The codes are
+// random, so a fast hash is enough to keep them useless if the table leaks.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with a fresh
+// set and returns them. They are only stored hashed, so this is the only
+// time they can be shown.
+func (m *Manager) RegenerateRecoveryCodes(ctx context.Context, userID uint) ([]string, error) {
+	codes, err := generateRecoveryCodes(m.cfg.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.store.GetDB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashRecoveryCode(code)); err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// useRecoveryCode consumes a recovery code, reporting whether it was valid
+// and unused
+func (m *Manager) useRecoveryCode(ctx context.Context, userID uint, code string) (bool, error) {
+	result, err := m.store.GetDB().ExecContext(ctx, `
+		UPDATE mfa_recovery_codes
+		SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	return n == 1, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes the user has
+func (m *Manager) RemainingRecoveryCodes(ctx context.Context, userID uint) (int, error) {
+	var n int
+	err := m.store.GetDB().QueryRowContext(ctx,
+		`SELECT count(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return n, nil
+}
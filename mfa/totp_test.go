@@ -0,0 +1,95 @@
+package mfa
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// The test vectors of RFC 6238 appendix B
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	secrets := map[string]string{
+		SHA1:   "12345678901234567890",
+		SHA256: "12345678901234567890123456789012",
+		SHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	vectors := []struct {
+		unix  int64
+		codes map[string]string
+	}{
+		{59, map[string]string{SHA1: "94287082", SHA256: "46119246", SHA512: "90693936"}},
+		{1111111109, map[string]string{SHA1: "07081804", SHA256: "68084774", SHA512: "25091201"}},
+		{1111111111, map[string]string{SHA1: "14050471", SHA256: "67062674", SHA512: "99943326"}},
+		{1234567890, map[string]string{SHA1: "89005924", SHA256: "91819424", SHA512: "93441116"}},
+		{2000000000, map[string]string{SHA1: "69279037", SHA256: "90698825", SHA512: "38618901"}},
+		{20000000000, map[string]string{SHA1: "65353130", SHA256: "77737706", SHA512: "47863826"}},
+	}
+
+	for _, v := range vectors {
+		at := time.Unix(v.unix, 0)
+		for algorithm, want := range v.codes {
+			totp := TOTP{Algorithm: algorithm, Digits: 8, Period: 30 * time.Second}
+			secret := secretEncoding.EncodeToString([]byte(secrets[algorithm]))
+
+			code, err := totp.Code(secret, at)
+			if err != nil {
+				t.Fatalf("%s at %d: %v", algorithm, v.unix, err)
+			}
+			if code != want {
+				t.Errorf("%s at %d: code %s, want %s", algorithm, v.unix, code, want)
+			}
+			if _, ok, err := totp.Validate(secret, want, at); err != nil || !ok {
+				t.Errorf("%s at %d: Validate = %v, %v", algorithm, v.unix, ok, err)
+			}
+		}
+	}
+}
+
+func TestTOTPValidateSkew(t *testing.T) {
+	totp := DefaultTOTP()
+	secret := secretEncoding.EncodeToString([]byte("12345678901234567890"))
+	at := time.Unix(1111111111, 0)
+
+	previous, err := totp.Code(secret, at.Add(-totp.Period))
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, ok, _ := totp.Validate(secret, previous, at); !ok {
+		t.Error("code of the previous period rejected")
+	}
+
+	stale, err := totp.Code(secret, at.Add(-2*totp.Period))
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, ok, _ := totp.Validate(secret, stale, at); ok {
+		t.Error("code from outside the skew window accepted")
+	}
+}
+
+func TestNewManagerValidatesDigits(t *testing.T) {
+	// sql.Open does not connect, which NewManager does not need
+	db, err := sql.Open("postgres", "host=localhost")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	store := &datastore.DBStore{DB: db}
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+
+	for digits, valid := range map[int]bool{0: true, 6: true, 7: true, 8: true, -1: false, 4: false, 9: false, 10: false} {
+		m, err := NewManager(store, rdb, Config{TOTP: TOTP{Digits: digits}})
+		if valid != (err == nil) {
+			t.Errorf("digits %d: err = %v", digits, err)
+			continue
+		}
+		if digits == 0 && m.cfg.TOTP.Digits != 6 {
+			t.Errorf("default digits = %d, want 6", m.cfg.TOTP.Digits)
+		}
+	}
+}
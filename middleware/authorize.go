@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// PolicyContextKey is where the server stores the active *Policy
+const PolicyContextKey = "policy"
+
+// Requirement reports whether the caller's claims satisfy an authorization rule
+type Requirement func(claims *JWTClaims, policy *Policy) bool
+
+// HasRole is satisfied by any of roles, or a role that inherits from one of them
+func HasRole(roles ...string) Requirement {
+	return func(claims *JWTClaims, policy *Policy) bool {
+		for _, role := range roles {
+			if policy.Satisfies(claims.Role, role) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasPermission is satisfied when the caller holds all of perms, either
+// directly in its claims or through its role
+func HasPermission(perms ...string) Requirement {
+	return func(claims *JWTClaims, policy *Policy) bool {
+		granted := make(map[string]bool)
+		for _, perm := range claims.Permissions {
+			granted[perm] = true
+		}
+		for _, perm := range perms {
+			if !granted[perm] && !policy.Allows(claims.Role, perm) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RequireRole allows requests from callers with any of roles
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return authorize(HasRole(roles...))
+}
+
+// RequirePermission allows requests from callers holding all of perms
+func RequirePermission(perms ...string) echo.MiddlewareFunc {
+	return authorize(HasPermission(perms...))
+}
+
+// RequireAny allows requests that satisfy at least one requirement
+func RequireAny(reqs ...Requirement) echo.MiddlewareFunc {
+	return authorize(func(claims *JWTClaims, policy *Policy) bool {
+		for _, req := range reqs {
+			if req(claims, policy) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireAll allows requests that satisfy every requirement
+func RequireAll(reqs ...Requirement) echo.MiddlewareFunc {
+	return authorize(func(claims *JWTClaims, policy *Policy) bool {
+		for _, req := range reqs {
+			if !req(claims, policy) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func authorize(req Requirement) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, ok := ClaimsFromContext(c)
+			if !ok {
+				return c.JSON(http.StatusUnauthorized, logger.ErrorResponse{
+					Success: false,
+					Errors: []map[string]string{{
+						"code":    "unauthorized",
+						"message": "Authentication required",
+					}},
+					Message: "Unauthorized",
+				})
+			}
+
+			policy, _ := c.Get(PolicyContextKey).(*Policy)
+			if !req(claims, policy) {
+				logger.SecurityEvent("access_denied",
+					zap.Uint("user_id", claims.UserID),
+					zap.String("username", claims.Username),
+					zap.String("role", claims.Role),
+					zap.String("method", c.Request().Method),
+					zap.String("route", c.Path()),
+				)
+				return c.JSON(http.StatusForbidden, logger.ErrorResponse{
+					Success: false,
+					Errors: []map[string]string{{
+						"code":    "forbidden",
+						"message": "You do not have permission to access this resource",
+					}},
+					Message: "Forbidden",
+				})
+			}
+
+			return next(c)
+		}
+	}
+}
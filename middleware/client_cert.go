@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// ClientCertConfig controls how client certificates become identities
+type ClientCertConfig struct {
+	// Required rejects requests without a verified client certificate.
+	// Otherwise such requests pass through without claims.
+	Required bool
+	// Identity maps a verified certificate to claims. Returning nil rejects
+	// the certificate. Defaults to DefaultCertIdentity.
+	Identity func(cert *x509.Certificate) *JWTClaims
+}
+
+// DefaultCertIdentity names the caller after the first URI SAN (such as a
+// SPIFFE ID), then the first DNS SAN, then the subject common name
+func DefaultCertIdentity(cert *x509.Certificate) *JWTClaims {
+	name := cert.Subject.CommonName
+	if len(cert.URIs) > 0 {
+		name = cert.URIs[0].String()
+	} else if len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return nil
+	}
+
+	claims := &JWTClaims{
+		Username:  name,
+		TokenType: TokenTypeClientCert,
+	}
+	claims.Subject = cert.Subject.String()
+	claims.ID = cert.SerialNumber.String()
+	return claims
+}
+
+// ClientCertAuth sets the claims of callers presenting a client certificate
+// the TLS handshake verified, so RequireRole and RequirePermission apply to
+// them as to token holders
+func ClientCertAuth(cfg ClientCertConfig) echo.MiddlewareFunc {
+	if cfg.Identity == nil {
+		cfg.Identity = DefaultCertIdentity
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := c.Request().TLS
+			// VerifiedChains is only set when the certificate chains to a
+			// trusted client CA
+			if state == nil || len(state.VerifiedChains) == 0 {
+				if cfg.Required {
+					return clientCertError(c, "client_certificate_required", "A valid client certificate is required")
+				}
+				return next(c)
+			}
+
+			cert := state.VerifiedChains[0][0]
+			claims := cfg.Identity(cert)
+			if claims == nil {
+				logger.SecurityEvent("client_certificate_rejected",
+					zap.String("subject", cert.Subject.String()),
+					zap.String("serial", cert.SerialNumber.String()),
+					zap.String("ip", c.RealIP()),
+				)
+				return clientCertError(c, "client_certificate_rejected", "The client certificate is not allowed")
+			}
+
+			c.Set(ClaimsContextKey, claims)
+			return next(c)
+		}
+	}
+}
+
+func clientCertError(c echo.Context, code, message string) error {
+	return c.JSON(http.StatusUnauthorized, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":    code,
+			"message": message,
+		}},
+		Message: "Unauthorized",
+	})
+}
@@ -0,0 +1,277 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Priority decides how a request is treated under load
+type Priority int
+
+const (
+	// PriorityNormal requests take a slot, queueing for one if needed
+	PriorityNormal Priority = iota
+	// PriorityLow requests are shed first: they never queue and are only
+	// admitted while the limiter has headroom
+	PriorityLow
+	// PriorityCritical requests, such as health checks and admin routes,
+	// bypass the limiter entirely
+	PriorityCritical
+)
+
+// ConcurrencyConfig configures a ConcurrencyLimiter
+type ConcurrencyConfig struct {
+	// MaxInFlight caps concurrent requests. The adaptive limit never rises
+	// above it. Defaults to 100.
+	MaxInFlight int `yaml:"maxInFlight"`
+	// MinInFlight is the floor of the adaptive limit. Defaults to 1.
+	MinInFlight int `yaml:"minInFlight"`
+	// MaxQueue caps how many requests may wait for a slot. Defaults to
+	// MaxInFlight.
+	MaxQueue int `yaml:"maxQueue"`
+	// QueueTimeout is how long a request waits for a slot before it is
+	// shed. Zero sheds without waiting.
+	QueueTimeout time.Duration `yaml:"queueTimeout"`
+	// TargetLatency enables the adaptive limit: while requests take longer
+	// than the target the limit shrinks multiplicatively, otherwise it grows
+	// by about one per limit's worth of requests (AIMD). Zero keeps the
+	// limit at MaxInFlight.
+	TargetLatency time.Duration `yaml:"targetLatency"`
+	// Backoff is the factor the limit shrinks by. Defaults to 0.9.
+	Backoff float64 `yaml:"backoff"`
+	// LowPriorityShare is the fraction of the limit low priority requests
+	// may use. Defaults to 0.8.
+	LowPriorityShare float64 `yaml:"lowPriorityShare"`
+	// RetryAfter is advertised to shed clients. Defaults to one second.
+	RetryAfter time.Duration `yaml:"retryAfter"`
+	// Priority classifies requests. Defaults to PriorityNormal for all.
+	Priority func(c echo.Context) Priority `yaml:"-"`
+}
+
+// ConcurrencyStats is a snapshot of a limiter's state
+type ConcurrencyStats struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// ConcurrencyLimiter caps in-flight requests and sheds load with 503 when
+// they pile up. Use one limiter globally and others per route group to
+// bound both.
+type ConcurrencyLimiter struct {
+	cfg ConcurrencyConfig
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	waiters      *list.List
+	lastDecrease time.Time
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewConcurrencyLimiter creates a limiter starting at cfg.MaxInFlight
+func NewConcurrencyLimiter(cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 100
+	}
+	if cfg.MinInFlight <= 0 {
+		cfg.MinInFlight = 1
+	}
+	if cfg.MinInFlight > cfg.MaxInFlight {
+		cfg.MinInFlight = cfg.MaxInFlight
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = cfg.MaxInFlight
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	if cfg.LowPriorityShare <= 0 || cfg.LowPriorityShare > 1 {
+		cfg.LowPriorityShare = 0.8
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = time.Second
+	}
+
+	return &ConcurrencyLimiter{
+		cfg:     cfg,
+		limit:   float64(cfg.MaxInFlight),
+		waiters: list.New(),
+	}
+}
+
+// CriticalPaths classifies requests under any of prefixes as
+// PriorityCritical and the rest as PriorityNormal
+func CriticalPaths(prefixes ...string) func(c echo.Context) Priority {
+	return func(c echo.Context) Priority {
+		path := c.Request().URL.Path
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) {
+				return PriorityCritical
+			}
+		}
+		return PriorityNormal
+	}
+}
+
+// Stats returns the current limit and load
+func (l *ConcurrencyLimiter) Stats() ConcurrencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ConcurrencyStats{
+		Limit:    l.currentLimit(),
+		InFlight: l.inFlight,
+		Queued:   l.waiters.Len(),
+	}
+}
+
+func (l *ConcurrencyLimiter) currentLimit() int {
+	return int(math.Floor(l.limit))
+}
+
+// Middleware admits requests up to the limit and sheds the rest
+func (l *ConcurrencyLimiter) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			priority := PriorityNormal
+			if l.cfg.Priority != nil {
+				priority = l.cfg.Priority(c)
+			}
+			if priority == PriorityCritical {
+				return next(c)
+			}
+
+			if !l.acquire(c.Request().Context(), priority) {
+				return l.shed(c)
+			}
+
+			start := time.Now()
+			defer func() {
+				l.release(time.Since(start))
+			}()
+			return next(c)
+		}
+	}
+}
+
+// acquire takes a slot, waiting up to the queue timeout for one
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, priority Priority) bool {
+	l.mu.Lock()
+
+	limit := l.currentLimit()
+	if priority == PriorityLow {
+		admitted := l.inFlight < int(float64(limit)*l.cfg.LowPriorityShare) && l.waiters.Len() == 0
+		if admitted {
+			l.inFlight++
+		}
+		l.mu.Unlock()
+		return admitted
+	}
+
+	// Queued requests go first so a burst cannot starve them
+	if l.inFlight < limit && l.waiters.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if l.cfg.QueueTimeout <= 0 || l.waiters.Len() >= l.cfg.MaxQueue {
+		l.mu.Unlock()
+		return false
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The slot may have been handed over while the timer fired
+	if w.granted {
+		return true
+	}
+	l.waiters.Remove(elem)
+	return false
+}
+
+// release frees a slot, adapts the limit to the request's latency and
+// hands free slots to queued requests
+func (l *ConcurrencyLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.adapt(latency)
+
+	for l.inFlight < l.currentLimit() && l.waiters.Len() > 0 {
+		w := l.waiters.Remove(l.waiters.Front()).(*waiter)
+		w.granted = true
+		l.inFlight++
+		close(w.ready)
+	}
+}
+
+// adapt applies AIMD to the limit. Decreases happen at most once per
+// target latency, so one burst of slow requests shrinks the limit once
+// rather than once per request.
+func (l *ConcurrencyLimiter) adapt(latency time.Duration) {
+	target := l.cfg.TargetLatency
+	if target <= 0 {
+		return
+	}
+
+	if latency > target {
+		now := time.Now()
+		if now.Sub(l.lastDecrease) < target {
+			return
+		}
+		l.lastDecrease = now
+		l.limit = math.Max(float64(l.cfg.MinInFlight), l.limit*l.cfg.Backoff)
+		return
+	}
+	l.limit = math.Min(float64(l.cfg.MaxInFlight), l.limit+1/l.limit)
+}
+
+func (l *ConcurrencyLimiter) shed(c echo.Context) error {
+	stats := l.Stats()
+	logger.Logger().Warn("Request shed",
+		zap.String("method", c.Request().Method),
+		zap.String("path", c.Request().URL.Path),
+		zap.Int("limit", stats.Limit),
+		zap.Int("in_flight", stats.InFlight),
+		zap.Int("queued", stats.Queued),
+	)
+
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(l.cfg.RetryAfter), 10))
+	return c.JSON(http.StatusServiceUnavailable, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":    "overloaded",
+			"message": "The server is busy, please retry later",
+		}},
+		Message: "Service unavailable",
+	})
+}
@@ -2,13 +2,103 @@ package middleware
 
 import (
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
 )
 
-type JWTCustomClaims struct {
-	UserID      int      `json:"user_id"`
-	Email       string   `json:"email"`
-	Role        string   `json:"role"`
-	Permissions []string `json:"permissions"`
-	DeviceID    string   `json:"device_id"`
+// ClaimsContextKey is where authentication middleware stores the caller's Claims
+const ClaimsContextKey = "claims"
+
+// Token types carried in the token_type claim
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	// TokenTypeMFAPending is issued after the password check of a user with
+	// MFA enabled. It is only accepted by the MFA verification endpoint.
+	TokenTypeMFAPending = "mfa_pending"
+	// TokenTypeAPIKey marks claims derived from an API key rather than a token
+	TokenTypeAPIKey = "api_key"
+	// TokenTypeService marks claims derived from a signed service request
+	TokenTypeService = "service"
+	// TokenTypeClientCert marks claims derived from a verified client certificate
+	TokenTypeClientCert = "client_cert"
+)
+
+// JWTClaims are the claims carried by every token the server issues.
+// Applications add their own claims by embedding JWTClaims in a struct and
+// registering a factory for it with server.WithClaims.
+type JWTClaims struct {
+	UserID      uint     `json:"user_id"`
+	Username    string   `json:"username,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	DeviceID    string   `json:"device_id,omitempty"`
+	// Plan names the caller's subscription tier for rate limit policies
+	Plan      string `json:"plan,omitempty"`
+	TokenType string `json:"token_type"`
+	// Act names the admin acting as this user on an impersonation token
+	Act *Actor `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
+
+// Actor identifies who is really making requests with an impersonation
+// token, as in the act claim of RFC 8693
+type Actor struct {
+	Subject  string `json:"sub"`
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username,omitempty"`
+}
+
+// JWTCustomClaims is the former name of JWTClaims
+//
+// Deprecated: use JWTClaims.
+type JWTCustomClaims = JWTClaims
+
+// Claims is implemented by *JWTClaims and by any struct that embeds JWTClaims
+type Claims interface {
+	jwt.Claims
+	Base() *JWTClaims
+}
+
+// Base returns the standard claims, letting embedding structs satisfy Claims
+func (c *JWTClaims) Base() *JWTClaims {
+	return c
+}
+
+// Impersonated reports whether the claims come from an impersonation token
+func (c *JWTClaims) Impersonated() bool {
+	return c.Act != nil
+}
+
+// ClaimsFromContext returns the standard claims of the authenticated caller
+func ClaimsFromContext(c echo.Context) (*JWTClaims, bool) {
+	claims, ok := claimsFromContext(c)
+	if !ok {
+		return nil, false
+	}
+	return claims.Base(), true
+}
+
+// CustomClaimsFromContext returns the caller's claims as the application's
+// registered claims type
+func CustomClaimsFromContext[T Claims](c echo.Context) (T, bool) {
+	claims, ok := claimsFromContext(c)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	custom, ok := claims.(T)
+	return custom, ok
+}
+
+func claimsFromContext(c echo.Context) (Claims, bool) {
+	if claims, ok := c.Get(ClaimsContextKey).(Claims); ok && claims != nil {
+		return claims, true
+	}
+	// Fall back to the token stored by echojwt
+	if token, ok := c.Get("user").(*jwt.Token); ok && token != nil {
+		claims, ok := token.Claims.(Claims)
+		return claims, ok
+	}
+	return nil, false
+}
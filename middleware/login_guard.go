@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ErrLockedOut matches every *LockoutError
+var ErrLockedOut = errors.New("too many failed login attempts")
+
+// LockoutError reports which key is locked and for how long
+type LockoutError struct {
+	// Scope is "username" or "ip"
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s locked out for %s: %v", e.Scope, e.RetryAfter.Round(time.Second), ErrLockedOut)
+}
+
+// Is makes errors.Is(err, ErrLockedOut) true
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// LoginGuardConfig controls brute-force protection
+type LoginGuardConfig struct {
+	// MaxAttempts is the number of failures per username within Window
+	// that triggers a lockout
+	MaxAttempts int `yaml:"maxAttempts"`
+	// MaxIPAttempts is the same threshold per client IP. It is usually
+	// higher, since many users can share an address.
+	MaxIPAttempts int `yaml:"maxIPAttempts"`
+	// Window is how long failures are counted
+	Window time.Duration `yaml:"window"`
+	// BaseLockout is the first lockout; every further lockout doubles it
+	BaseLockout time.Duration `yaml:"baseLockout"`
+	// MaxLockout caps the exponential backoff
+	MaxLockout time.Duration `yaml:"maxLockout"`
+	// LockoutMemory is how long past lockouts count towards the backoff
+	LockoutMemory time.Duration `yaml:"lockoutMemory"`
+}
+
+// DefaultLoginGuardConfig returns conservative thresholds
+func DefaultLoginGuardConfig() LoginGuardConfig {
+	return LoginGuardConfig{
+		MaxAttempts:   5,
+		MaxIPAttempts: 50,
+		Window:        15 * time.Minute,
+		BaseLockout:   time.Minute,
+		MaxLockout:    time.Hour,
+		LockoutMemory: 24 * time.Hour,
+	}
+}
+
+// LoginGuard tracks failed logins in Redis by username and by IP
+type LoginGuard struct {
+	rdb *redis.Client
+	cfg LoginGuardConfig
+}
+
+// NewLoginGuard creates a guard; zero config fields take their defaults
+func NewLoginGuard(rdb *redis.Client, cfg LoginGuardConfig) *LoginGuard {
+	def := DefaultLoginGuardConfig()
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.MaxIPAttempts <= 0 {
+		cfg.MaxIPAttempts = def.MaxIPAttempts
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.BaseLockout <= 0 {
+		cfg.BaseLockout = def.BaseLockout
+	}
+	if cfg.MaxLockout <= 0 {
+		cfg.MaxLockout = def.MaxLockout
+	}
+	if cfg.LockoutMemory <= 0 {
+		cfg.LockoutMemory = def.LockoutMemory
+	}
+	return &LoginGuard{rdb: rdb, cfg: cfg}
+}
+
+// recordFailureScript counts a failure and locks the key once the
+// threshold is reached, doubling the lockout for every recent lockout.
+// KEYS: failures, lock, lockouts
+// ARGV: threshold, window ms, base lockout ms, max lockout ms, memory ms
+// Returns the lockout in ms, or 0 if the key is not locked.
+var recordFailureScript = redis.NewScript(`
+local failures = redis.call('INCR', KEYS[1])
+if failures == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if failures < tonumber(ARGV[1]) then
+	return 0
+end
+local lockouts = redis.call('INCR', KEYS[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[5])
+local lockout = tonumber(ARGV[3]) * math.pow(2, lockouts - 1)
+if lockout > tonumber(ARGV[4]) then
+	lockout = tonumber(ARGV[4])
+end
+lockout = math.floor(lockout)
+redis.call('SET', KEYS[2], 1, 'PX', lockout)
+redis.call('DEL', KEYS[1])
+return lockout
+`)
+
+func guardKeys(scope, id string) []string {
+	return []string{
+		fmt.Sprintf("login_failures:%s:%s", scope, id),
+		fmt.Sprintf("login_lock:%s:%s", scope, id),
+		fmt.Sprintf("login_lockouts:%s:%s", scope, id),
+	}
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Check returns a *LockoutError if the username or the IP is locked out
+func (g *LoginGuard) Check(ctx context.Context, username, ip string) error {
+	username = normalizeUsername(username)
+
+	var userTTL, ipTTL *redis.DurationCmd
+	_, err := g.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if username != "" {
+			userTTL = pipe.PTTL(ctx, guardKeys("username", username)[1])
+		}
+		if ip != "" {
+			ipTTL = pipe.PTTL(ctx, guardKeys("ip", ip)[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check login lockout: %w", err)
+	}
+
+	if userTTL != nil && userTTL.Val() > 0 {
+		return &LockoutError{Scope: "username", RetryAfter: userTTL.Val()}
+	}
+	if ipTTL != nil && ipTTL.Val() > 0 {
+		return &LockoutError{Scope: "ip", RetryAfter: ipTTL.Val()}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed login and returns a *LockoutError if it
+// caused a lockout
+func (g *LoginGuard) RecordFailure(ctx context.Context, username, ip string) error {
+	username = normalizeUsername(username)
+
+	var lockErr error
+	if username != "" {
+		lockout, err := g.recordFailure(ctx, "username", username, g.cfg.MaxAttempts)
+		if err != nil {
+			return err
+		}
+		if lockout > 0 {
+			logger.SecurityEvent("login_lockout",
+				zap.String("username", username),
+				zap.String("ip", ip),
+				zap.Duration("lockout", lockout),
+			)
+			lockErr = &LockoutError{Scope: "username", RetryAfter: lockout}
+		}
+	}
+
+	if ip != "" {
+		lockout, err := g.recordFailure(ctx, "ip", ip, g.cfg.MaxIPAttempts)
+		if err != nil {
+			return err
+		}
+		if lockout > 0 {
+			logger.SecurityEvent("login_lockout",
+				zap.String("ip", ip),
+				zap.Duration("lockout", lockout),
+			)
+			if lockErr == nil {
+				lockErr = &LockoutError{Scope: "ip", RetryAfter: lockout}
+			}
+		}
+	}
+
+	return lockErr
+}
+
+// recordFailure returns the lockout the failure triggered, if any
+func (g *LoginGuard) recordFailure(ctx context.Context, scope, id string, threshold int) (time.Duration, error) {
+	lockout, err := recordFailureScript.Run(ctx, g.rdb, guardKeys(scope, id),
+		threshold,
+		g.cfg.Window.Milliseconds(),
+		g.cfg.BaseLockout.Milliseconds(),
+		g.cfg.MaxLockout.Milliseconds(),
+		g.cfg.LockoutMemory.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to record login failure: %w", err)
+	}
+	return time.Duration(lockout) * time.Millisecond, nil
+}
+
+// RecordSuccess clears the username's failures and lockout history. IP
+// counters are kept, since one good login says nothing about other
+// attempts from the same address.
+func (g *LoginGuard) RecordSuccess(ctx context.Context, username string) error {
+	keys := guardKeys("username", normalizeUsername(username))
+	if err := g.rdb.Del(ctx, keys[0], keys[2]).Err(); err != nil {
+		return fmt.Errorf("failed to reset login failures: %w", err)
+	}
+	return nil
+}
+
+// Unlock lifts a username lockout early, for support staff
+func (g *LoginGuard) Unlock(ctx context.Context, username string) error {
+	username = normalizeUsername(username)
+	if err := g.rdb.Del(ctx, guardKeys("username", username)...).Err(); err != nil {
+		return fmt.Errorf("failed to unlock account: %w", err)
+	}
+	logger.SecurityEvent("login_unlock", zap.String("username", username))
+	return nil
+}
+
+// UnlockIP lifts an IP lockout early
+func (g *LoginGuard) UnlockIP(ctx context.Context, ip string) error {
+	if err := g.rdb.Del(ctx, guardKeys("ip", ip)...).Err(); err != nil {
+		return fmt.Errorf("failed to unlock ip: %w", err)
+	}
+	logger.SecurityEvent("login_unlock", zap.String("ip", ip))
+	return nil
+}
+
+// Middleware protects a login handler that does not use the guard itself.
+// Locked out requests are rejected before reaching the handler; 401
+// responses count as failures and 2xx responses as successes. username
+// extracts the attempted username; nil reads the "username" field of a
+// JSON or form body.
+func (g *LoginGuard) Middleware(username func(c echo.Context) string) echo.MiddlewareFunc {
+	if username == nil {
+		username = usernameFromBody
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			name := username(c)
+			ip := c.RealIP()
+
+			if err := g.Check(ctx, name, ip); err != nil {
+				return LockoutResponse(c, err)
+			}
+
+			err := next(c)
+
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+			switch {
+			case status == http.StatusUnauthorized:
+				if recordErr := g.RecordFailure(ctx, name, ip); recordErr != nil && !errors.Is(recordErr, ErrLockedOut) {
+					logger.Logger().Error("Failed to record login failure", logger.WithError(recordErr))
+				}
+			case status >= 200 && status < 300:
+				if recordErr := g.RecordSuccess(ctx, name); recordErr != nil {
+					logger.Logger().Error("Failed to reset login failures", logger.WithError(recordErr))
+				}
+			}
+			return err
+		}
+	}
+}
+
+// LockoutResponse writes 429 with Retry-After for a *LockoutError, and 503
+// for a failure to reach the lockout store
+func LockoutResponse(c echo.Context, err error) error {
+	var lockErr *LockoutError
+	if !errors.As(err, &lockErr) {
+		logger.Logger().Error("Login guard unavailable", logger.WithError(err))
+		return c.JSON(http.StatusServiceUnavailable, logger.ErrorResponse{
+			Success: false,
+			Errors: []map[string]string{{
+				"code":    "service_unavailable",
+				"message": "Login is temporarily unavailable",
+			}},
+			Message: "Login is temporarily unavailable",
+		})
+	}
+
+	retryAfter := int(math.Ceil(lockErr.RetryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return c.JSON(http.StatusTooManyRequests, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":        "login_locked",
+			"message":     "Too many failed login attempts",
+			"retry_after": strconv.Itoa(retryAfter),
+		}},
+		Message: "Too many failed login attempts",
+	})
+}
+
+// usernameFromBody peeks at the request body without consuming it
+func usernameFromBody(c echo.Context) string {
+	req := c.Request()
+	if !strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return c.FormValue("username")
+	}
+	if req.Body == nil {
+		return ""
+	}
+
+	// Only the start of the body is needed; put it back in front of the rest
+	body, err := io.ReadAll(io.LimitReader(req.Body, 64<<10))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+
+	var fields struct {
+		Username string `json:"username"`
+	}
+	_ = json.Unmarshal(body, &fields)
+	return fields.Username
+}
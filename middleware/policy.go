@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyConfig declares roles and the permissions they grant
+type PolicyConfig struct {
+	Roles map[string]RoleConfig `yaml:"roles"`
+}
+
+// RoleConfig declares a role's own permissions and the roles it inherits
+type RoleConfig struct {
+	Inherits    []string `yaml:"inherits"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// Policy is a resolved role hierarchy. A role satisfies every role it
+// inherits from, directly or transitively, and holds all their permissions.
+type Policy struct {
+	roles map[string]*resolvedRole
+}
+
+type resolvedRole struct {
+	satisfies   map[string]bool
+	permissions map[string]bool
+}
+
+// NewPolicy resolves the role hierarchy, rejecting unknown and cyclic inheritance
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	p := &Policy{roles: make(map[string]*resolvedRole, len(cfg.Roles))}
+
+	var resolve func(name string, path []string) (*resolvedRole, error)
+	resolve = func(name string, path []string) (*resolvedRole, error) {
+		if role, ok := p.roles[name]; ok {
+			return role, nil
+		}
+		for _, seen := range path {
+			if seen == name {
+				return nil, fmt.Errorf("role inheritance cycle: %v", append(path, name))
+			}
+		}
+		def, ok := cfg.Roles[name]
+		if !ok {
+			return nil, fmt.Errorf("role %q inherits unknown role", path[len(path)-1])
+		}
+
+		role := &resolvedRole{
+			satisfies:   map[string]bool{name: true},
+			permissions: make(map[string]bool),
+		}
+		for _, perm := range def.Permissions {
+			role.permissions[perm] = true
+		}
+		for _, parentName := range def.Inherits {
+			parent, err := resolve(parentName, append(path, name))
+			if err != nil {
+				return nil, err
+			}
+			for r := range parent.satisfies {
+				role.satisfies[r] = true
+			}
+			for perm := range parent.permissions {
+				role.permissions[perm] = true
+			}
+		}
+
+		p.roles[name] = role
+		return role, nil
+	}
+
+	for name := range cfg.Roles {
+		if _, err := resolve(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// LoadPolicy reads a PolicyConfig from a YAML or JSON file. Role names
+// are case sensitive.
+func LoadPolicy(path string) (*Policy, error) {
+	// Not viper, which lowercases map keys and so the role names
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var cfg PolicyConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode policy: %w", err)
+	}
+	return NewPolicy(cfg)
+}
+
+// Satisfies reports whether role is required or inherits from it
+func (p *Policy) Satisfies(role, required string) bool {
+	if role == required {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	r, ok := p.roles[role]
+	return ok && r.satisfies[required]
+}
+
+// Allows reports whether role grants permission. The "*" permission grants everything.
+func (p *Policy) Allows(role, permission string) bool {
+	if p == nil {
+		return false
+	}
+	r, ok := p.roles[role]
+	return ok && (r.permissions[permission] || r.permissions["*"])
+}
+
+// Permissions lists every permission role grants, including inherited ones
+func (p *Policy) Permissions(role string) []string {
+	if p == nil {
+		return nil
+	}
+	r, ok := p.roles[role]
+	if !ok {
+		return nil
+	}
+	perms := make([]string, 0, len(r.permissions))
+	for perm := range r.permissions {
+		perms = append(perms, perm)
+	}
+	sort.Strings(perms)
+	return perms
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadPolicyKeepsRoleCase(t *testing.T) {
+	p, err := LoadPolicy(writeConfig(t, "policy.yaml", `
+roles:
+  Editor:
+    permissions: [posts.write]
+  SuperAdmin:
+    inherits: [Editor]
+    permissions: [users.manage]
+`))
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+	if !p.Satisfies("SuperAdmin", "Editor") {
+		t.Error("SuperAdmin does not satisfy Editor")
+	}
+	if !p.Allows("SuperAdmin", "posts.write") || !p.Allows("SuperAdmin", "users.manage") {
+		t.Errorf("SuperAdmin permissions = %v", p.Permissions("SuperAdmin"))
+	}
+	if p.Allows("superadmin", "users.manage") {
+		t.Error("role names matched case insensitively")
+	}
+}
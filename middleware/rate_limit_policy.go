@@ -0,0 +1,321 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// What a rate limit rule counts requests by
+const (
+	// RateLimitByIP counts requests per client IP
+	RateLimitByIP = "ip"
+	// RateLimitByUser counts requests per authenticated user, and per IP for
+	// anonymous callers
+	RateLimitByUser = "user"
+	// RateLimitByAPIKey counts requests per API key, and per user or IP for
+	// callers without one
+	RateLimitByAPIKey = "api_key"
+	// RateLimitByRoute counts every request to a route together
+	RateLimitByRoute = "route"
+)
+
+// RateLimitRule limits the requests it matches
+type RateLimitRule struct {
+	// Name identifies the rule in Redis keys and logs. Defaults to its
+	// position in the policy.
+	Name string `yaml:"name"`
+	// Path matches route paths by prefix, such as /api/reports. Empty
+	// matches every route.
+	Path string `yaml:"path"`
+	// Methods restricts the rule to these HTTP methods. Empty matches all.
+	Methods []string `yaml:"methods"`
+	// Key is what requests are counted by; one of the RateLimitBy
+	// constants. Defaults to RateLimitByUser.
+	Key string `yaml:"key"`
+	// Limit applies to callers whose plan has no entry in Plans
+	Limit Limit `yaml:"limit"`
+	// Plans overrides Limit for callers on a plan, as named by their plan
+	// claim. Plan names are case insensitive, as config loaders such as
+	// viper lowercase map keys.
+	Plans map[string]Limit `yaml:"plans"`
+}
+
+// RateLimitPolicyConfig declares rate limit rules. Every rule matching a
+// request applies, so a global per-user rule can be combined with tighter
+// rules for expensive routes. Requests matching no rule are not limited.
+type RateLimitPolicyConfig struct {
+	Rules []RateLimitRule `yaml:"rules"`
+	// DefaultPlan is the plan of callers whose claims name none
+	DefaultPlan string `yaml:"defaultPlan"`
+}
+
+// RateLimitPolicy holds the active rules. It is safe to Update while
+// requests are being served.
+type RateLimitPolicy struct {
+	cfg atomic.Pointer[RateLimitPolicyConfig]
+}
+
+// NewRateLimitPolicy validates cfg and returns a policy enforcing it
+func NewRateLimitPolicy(cfg RateLimitPolicyConfig) (*RateLimitPolicy, error) {
+	p := &RateLimitPolicy{}
+	if err := p.Update(cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadRateLimitPolicy reads a RateLimitPolicyConfig from a YAML or JSON file
+func LoadRateLimitPolicy(path string) (*RateLimitPolicy, error) {
+	cfg, err := readRateLimitPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRateLimitPolicy(*cfg)
+}
+
+// Reload replaces the rules with those in a YAML or JSON file. The current
+// rules stay in force if the file is invalid.
+func (p *RateLimitPolicy) Reload(path string) error {
+	cfg, err := readRateLimitPolicy(path)
+	if err != nil {
+		return err
+	}
+	return p.Update(*cfg)
+}
+
+func readRateLimitPolicy(path string) (*RateLimitPolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit policy file: %w", err)
+	}
+
+	var cfg RateLimitPolicyConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode rate limit policy: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Update validates cfg and makes it the active policy
+func (p *RateLimitPolicy) Update(cfg RateLimitPolicyConfig) error {
+	rules := make([]RateLimitRule, len(cfg.Rules))
+	names := make(map[string]bool, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rate limit rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		switch rule.Key {
+		case "":
+			rule.Key = RateLimitByUser
+		case RateLimitByIP, RateLimitByUser, RateLimitByAPIKey, RateLimitByRoute:
+		default:
+			return fmt.Errorf("rate limit rule %q has unknown key %q", rule.Name, rule.Key)
+		}
+
+		if err := validateLimit(rule.Limit); err != nil {
+			return fmt.Errorf("rate limit rule %q: %w", rule.Name, err)
+		}
+		plans := make(map[string]Limit, len(rule.Plans))
+		for plan, limit := range rule.Plans {
+			if err := validateLimit(limit); err != nil {
+				return fmt.Errorf("rate limit rule %q plan %q: %w", rule.Name, plan, err)
+			}
+			if _, ok := plans[strings.ToLower(plan)]; ok {
+				return fmt.Errorf("rate limit rule %q has duplicate plan %q", rule.Name, plan)
+			}
+			plans[strings.ToLower(plan)] = limit
+		}
+		rule.Plans = plans
+
+		methods := make([]string, len(rule.Methods))
+		for j, method := range rule.Methods {
+			methods[j] = strings.ToUpper(method)
+		}
+		rule.Methods = methods
+		rules[i] = rule
+	}
+
+	cfg.Rules = rules
+	p.cfg.Store(&cfg)
+	return nil
+}
+
+func validateLimit(l Limit) error {
+	if l.Requests <= 0 || l.Period <= 0 {
+		return fmt.Errorf("limit requires positive requests and period")
+	}
+	// GCRA spaces requests by period/requests, which must not round to zero
+	if l.emissionInterval() <= 0 {
+		return fmt.Errorf("limit of %d requests per %s is too fine grained", l.Requests, l.Period)
+	}
+	return nil
+}
+
+// Config returns the active policy
+func (p *RateLimitPolicy) Config() RateLimitPolicyConfig {
+	return *p.cfg.Load()
+}
+
+// matches reports whether the rule applies to a request for route
+func (r *RateLimitRule) matches(method, route string) bool {
+	if r.Path != "" && route != r.Path && !strings.HasPrefix(route, strings.TrimSuffix(r.Path, "/")+"/") {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// limitFor picks the limit of the caller's plan
+func (r *RateLimitRule) limitFor(plan string) Limit {
+	if limit, ok := r.Plans[strings.ToLower(plan)]; ok {
+		return limit
+	}
+	return r.Limit
+}
+
+// identify derives the counter a request is charged to
+func (r *RateLimitRule) identify(c echo.Context, route string) string {
+	claims, authenticated := ClaimsFromContext(c)
+
+	switch r.Key {
+	case RateLimitByRoute:
+		return "route:" + c.Request().Method + " " + route
+	case RateLimitByAPIKey:
+		if authenticated && claims.TokenType == TokenTypeAPIKey {
+			return "key:" + claims.ID
+		}
+		fallthrough
+	case RateLimitByUser:
+		if authenticated && claims.UserID != 0 {
+			return "user:" + strconv.FormatUint(uint64(claims.UserID), 10)
+		}
+	}
+	return "ip:" + c.RealIP()
+}
+
+// RateLimit enforces policy with counters in store. Use it after the
+// authentication middleware so rules can key on the caller and their plan.
+// A request is counted against every matching rule, or against none when
+// any of them denies it.
+// Responses to limited routes carry RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers for the most constrained matching rule, and
+// denied requests also carry Retry-After.
+func RateLimit(store *RedisRateLimiterStore, policy *RateLimitPolicy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := policy.cfg.Load()
+
+			route := c.Path()
+			if route == "" {
+				route = c.Request().URL.Path
+			}
+			method := c.Request().Method
+
+			plan := cfg.DefaultPlan
+			if claims, ok := ClaimsFromContext(c); ok && claims.Plan != "" {
+				plan = claims.Plan
+			}
+
+			var rules []*RateLimitRule
+			var identities, keys []string
+			var limits []Limit
+			for i := range cfg.Rules {
+				rule := &cfg.Rules[i]
+				if !rule.matches(method, route) {
+					continue
+				}
+				identity := rule.identify(c, route)
+				rules = append(rules, rule)
+				identities = append(identities, identity)
+				keys = append(keys, rule.Name+":"+identity)
+				limits = append(limits, rule.limitFor(plan))
+			}
+			if len(rules) == 0 {
+				return next(c)
+			}
+
+			results, err := store.TakeAll(c.Request().Context(), keys, limits)
+			if err != nil {
+				return err
+			}
+
+			// A denied request reports the rule it has to wait longest for,
+			// an allowed one the rule with the least room left
+			denied, tightest := -1, -1
+			for i, result := range results {
+				if !result.Allowed {
+					if denied < 0 || result.RetryAfter > results[denied].RetryAfter {
+						denied = i
+					}
+				} else if tightest < 0 || result.Remaining < results[tightest].Remaining {
+					tightest = i
+				}
+			}
+			if denied >= 0 {
+				logger.Logger().Info("Rate limit exceeded",
+					zap.String("rule", rules[denied].Name),
+					zap.String("identity", identities[denied]),
+					zap.String("plan", plan),
+				)
+				return RateLimitExceeded(c, results[denied])
+			}
+
+			SetRateLimitHeaders(c, results[tightest])
+			return next(c)
+		}
+	}
+}
+
+// SetRateLimitHeaders describes the caller's quota in the IETF RateLimit
+// headers
+func SetRateLimitHeaders(c echo.Context, result *RateLimitResult) {
+	h := c.Response().Header()
+	h.Set("RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(result.ResetAfter), 10))
+}
+
+// RateLimitExceeded answers a denied request with 429, the RateLimit
+// headers and Retry-After
+func RateLimitExceeded(c echo.Context, result *RateLimitResult) error {
+	SetRateLimitHeaders(c, result)
+	retryAfter := ceilSeconds(result.RetryAfter)
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+
+	return c.JSON(http.StatusTooManyRequests, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":        "rate_limited",
+			"message":     "Too many requests",
+			"retry_after": strconv.FormatInt(retryAfter, 10),
+		}},
+		Message: "Too many requests",
+	})
+}
+
+// ceilSeconds rounds d up to whole seconds, so clients never retry early
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
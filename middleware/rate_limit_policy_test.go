@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLoadRateLimitPolicyMatchesPlansOfAnyCase(t *testing.T) {
+	p, err := LoadRateLimitPolicy(writeConfig(t, "limits.json", `{
+		"defaultPlan": "Free",
+		"rules": [{
+			"name": "api",
+			"limit": {"requests": 10, "period": "1m"},
+			"plans": {"Pro": {"requests": 100, "period": "1m"}}
+		}]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadRateLimitPolicy: %v", err)
+	}
+
+	cfg := p.Config()
+	if cfg.DefaultPlan != "Free" {
+		t.Errorf("DefaultPlan = %q", cfg.DefaultPlan)
+	}
+	rule := cfg.Rules[0]
+	for _, plan := range []string{"Pro", "pro", "PRO"} {
+		if limit := rule.limitFor(plan); limit.Requests != 100 || limit.Period != time.Minute {
+			t.Errorf("limit of plan %q = %+v", plan, limit)
+		}
+	}
+	if limit := rule.limitFor("Free"); limit.Requests != 10 {
+		t.Errorf("limit of plan Free = %+v", limit)
+	}
+}
+
+func TestRateLimitPolicyRejectsPlansDifferingInCase(t *testing.T) {
+	_, err := NewRateLimitPolicy(RateLimitPolicyConfig{Rules: []RateLimitRule{{
+		Limit: Limit{Requests: 1, Period: time.Second},
+		Plans: map[string]Limit{
+			"pro": {Requests: 1, Period: time.Second},
+			"Pro": {Requests: 2, Period: time.Second},
+		},
+	}}})
+	if err == nil {
+		t.Error("accepted plans pro and Pro")
+	}
+}
+
+func TestRateLimitDoesNotChargeRulesOfDeniedRequests(t *testing.T) {
+	stores := map[string]*redis.Client{
+		"redis":  redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+		"memory": nil,
+	}
+	for name, rdb := range stores {
+		store, err := NewRedisRateLimiterStore(rdb, RateLimiterStoreConfig{})
+		if err != nil {
+			t.Fatalf("%s: NewRedisRateLimiterStore: %v", name, err)
+		}
+		policy, err := NewRateLimitPolicy(RateLimitPolicyConfig{Rules: []RateLimitRule{
+			{Name: "global", Key: RateLimitByIP, Limit: Limit{Requests: 10, Period: time.Minute}},
+			{Name: "export", Key: RateLimitByIP, Path: "/export", Limit: Limit{Requests: 1, Period: time.Minute}},
+		}})
+		if err != nil {
+			t.Fatalf("%s: NewRateLimitPolicy: %v", name, err)
+		}
+
+		e := echo.New()
+		e.Use(RateLimit(store, policy))
+		ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+		e.GET("/export", ok)
+		e.GET("/items", ok)
+		serve := func(path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			return rec
+		}
+
+		if rec := serve("/export"); rec.Code != http.StatusOK {
+			t.Fatalf("%s: first export: status %d", name, rec.Code)
+		}
+		for i := 0; i < 3; i++ {
+			if rec := serve("/export"); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("%s: repeated export: status %d", name, rec.Code)
+			}
+		}
+
+		// Only the allowed export and this request count against the
+		// global rule
+		rec := serve("/items")
+		if remaining := rec.Header().Get("RateLimit-Remaining"); rec.Code != http.StatusOK || remaining != "8" {
+			t.Errorf("%s: items: status %d, remaining %s; want 8", name, rec.Code, remaining)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit is a request rate: Requests per Period on average, with up to
+// Burst requests at once
+type Limit struct {
+	Requests int64         `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	// Burst defaults to Requests
+	Burst int64 `yaml:"burst"`
+}
+
+// burst returns the effective burst size
+func (l Limit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// emissionInterval is the time one request's quota takes to refill
+func (l Limit) emissionInterval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+// RateLimiterStoreConfig configures a RedisRateLimiterStore
+type RateLimiterStoreConfig struct {
+	// Limit is enforced by Allow. It may be left empty for stores used
+	// only through RateLimit, which takes limits from its policy.
+	Limit Limit `yaml:"limit"`
+	// Prefix namespaces the Redis keys. Defaults to "rate_limit:".
+	Prefix string `yaml:"prefix"`
+	// RetryInterval is how long the store stays on its in-memory fallback
+	// after Redis fails before trying Redis again. Defaults to 5 seconds.
+	RetryInterval time.Duration `yaml:"retryInterval"`
+}
+
+// gcraScript implements the generic cell rate algorithm for one or more
+// keys, each with its own limit given as an emission interval and burst
+// pair in ARGV. Each key holds the theoretical arrival time (TAT) of its
+// next request in milliseconds; Redis' clock is used so every replica
+// agrees on the time. The request is counted against every key only if
+// all of them allow it.
+// Returns {allowed, remaining, retry_after_ms, reset_after_ms} per key.
+var gcraScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+
+local results = {}
+local new_tats = {}
+local allowed = true
+for i, key in ipairs(KEYS) do
+	local emission = tonumber(ARGV[2 * i - 1])
+	local tolerance = emission * tonumber(ARGV[2 * i])
+
+	local tat = tonumber(redis.call('GET', key) or now)
+	if tat < now then
+		tat = now
+	end
+
+	local new_tat = tat + emission
+	local diff = now - (new_tat - tolerance)
+	local n = #results
+	if diff < 0 then
+		allowed = false
+		results[n + 1], results[n + 2] = 0, 0
+		results[n + 3], results[n + 4] = math.ceil(-diff), math.ceil(tat - now)
+	else
+		new_tats[i] = new_tat
+		results[n + 1], results[n + 2] = 1, math.floor(diff / emission)
+		results[n + 3], results[n + 4] = 0, math.ceil(new_tat - now)
+	end
+end
+
+if allowed then
+	for i, key in ipairs(KEYS) do
+		redis.call('SET', key, string.format('%d', math.floor(new_tats[i])), 'PX', math.ceil(new_tats[i] - now))
+	end
+end
+return results
+`)
+
+// RateLimitResult is the outcome of counting one request against a quota
+type RateLimitResult struct {
+	// Allowed reports whether the quota had room for the request. With
+	// TakeAll the request is only counted if every quota had room.
+	Allowed bool
+	// Limit is the quota: how many requests may be made at once
+	Limit int64
+	// Remaining is how many more requests would be allowed right now
+	Remaining int64
+	// RetryAfter is how long a denied client must wait
+	RetryAfter time.Duration
+	// ResetAfter is how long until the full quota is available again
+	ResetAfter time.Duration
+}
+
+// RedisRateLimiterStore is an echo RateLimiterStore that keeps its state
+// in Redis, so a limit holds across every replica. When Redis cannot be
+// reached it falls back to counting in process memory until Redis recovers.
+type RedisRateLimiterStore struct {
+	rdb *redis.Client
+	cfg RateLimiterStoreConfig
+
+	// downUntil is when to try Redis again after a failure, in Unix nanoseconds
+	downUntil atomic.Int64
+
+	fallback *memoryGCRA
+}
+
+// NewRedisRateLimiterStore creates a store. rdb may be nil to keep limits
+// in memory only.
+func NewRedisRateLimiterStore(rdb *redis.Client, cfg RateLimiterStoreConfig) (*RedisRateLimiterStore, error) {
+	if cfg.Limit != (Limit{}) {
+		if err := validateLimit(cfg.Limit); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "rate_limit:"
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+
+	return &RedisRateLimiterStore{
+		rdb:      rdb,
+		cfg:      cfg,
+		fallback: newMemoryGCRA(),
+	}, nil
+}
+
+// Allow implements middleware.RateLimiterStore
+func (s *RedisRateLimiterStore) Allow(identifier string) (bool, error) {
+	if s.cfg.Limit == (Limit{}) {
+		return false, fmt.Errorf("rate limiter store has no limit")
+	}
+	result, err := s.Take(context.Background(), identifier, s.cfg.Limit)
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+// Take counts one request against key's quota under limit
+func (s *RedisRateLimiterStore) Take(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	results, err := s.TakeAll(ctx, []string{key}, []Limit{limit})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// TakeAll counts one request against the quota of every key, each under
+// the limit at the same index, if all of them allow it. A request denied
+// by one quota is counted against none, so it does not use up the others.
+func (s *RedisRateLimiterStore) TakeAll(ctx context.Context, keys []string, limits []Limit) ([]*RateLimitResult, error) {
+	if len(keys) != len(limits) {
+		return nil, fmt.Errorf("got %d rate limit keys for %d limits", len(keys), len(limits))
+	}
+	for _, limit := range limits {
+		if err := validateLimit(limit); err != nil {
+			return nil, err
+		}
+	}
+	if s.rdb == nil || time.Now().UnixNano() < s.downUntil.Load() {
+		return s.fallback.takeAll(keys, limits, time.Now()), nil
+	}
+
+	prefixed := make([]string, len(keys))
+	args := make([]interface{}, 0, 2*len(limits))
+	for i, key := range keys {
+		prefixed[i] = s.cfg.Prefix + key
+		args = append(args,
+			float64(limits[i].emissionInterval())/float64(time.Millisecond),
+			limits[i].burst())
+	}
+	reply, err := gcraScript.Run(ctx, s.rdb, prefixed, args...).Int64Slice()
+	if err != nil {
+		s.markDown(err)
+		return s.fallback.takeAll(keys, limits, time.Now()), nil
+	}
+	s.markUp()
+
+	results := make([]*RateLimitResult, len(keys))
+	for i := range results {
+		r := reply[4*i : 4*i+4]
+		results[i] = &RateLimitResult{
+			Allowed:    r[0] == 1,
+			Limit:      limits[i].burst(),
+			Remaining:  r[1],
+			RetryAfter: time.Duration(r[2]) * time.Millisecond,
+			ResetAfter: time.Duration(r[3]) * time.Millisecond,
+		}
+	}
+	return results, nil
+}
+
+// markDown switches to the fallback for the retry interval
+func (s *RedisRateLimiterStore) markDown(err error) {
+	next := time.Now().Add(s.cfg.RetryInterval).UnixNano()
+	if s.downUntil.Swap(next) == 0 {
+		logger.Logger().Warn("Rate limiter falling back to in-memory limits", logger.WithError(err))
+	}
+}
+
+func (s *RedisRateLimiterStore) markUp() {
+	if s.downUntil.Swap(0) != 0 {
+		logger.Logger().Info("Rate limiter using Redis again")
+	}
+}
+
+// memoryGCRA runs the same algorithm as gcraScript in process memory. It
+// backs the Redis store while Redis is unreachable; limits are then per
+// process, so the effective limit is multiplied by the number of replicas.
+type memoryGCRA struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryGCRA() *memoryGCRA {
+	return &memoryGCRA{tats: map[string]time.Time{}}
+}
+
+func (m *memoryGCRA) takeAll(keys []string, limits []Limit, now time.Time) []*RateLimitResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(now)
+
+	results := make([]*RateLimitResult, len(keys))
+	newTATs := make([]time.Time, len(keys))
+	allowed := true
+	for i, key := range keys {
+		limit := limits[i]
+		emission := limit.emissionInterval()
+		tolerance := emission * time.Duration(limit.burst())
+		tat, ok := m.tats[key]
+		if !ok || tat.Before(now) {
+			tat = now
+		}
+
+		newTATs[i] = tat.Add(emission)
+		diff := now.Sub(newTATs[i].Add(-tolerance))
+		if diff < 0 {
+			allowed = false
+			results[i] = &RateLimitResult{
+				Limit:      limit.burst(),
+				RetryAfter: -diff,
+				ResetAfter: tat.Sub(now),
+			}
+			continue
+		}
+		results[i] = &RateLimitResult{
+			Allowed:    true,
+			Limit:      limit.burst(),
+			Remaining:  int64(diff / emission),
+			ResetAfter: newTATs[i].Sub(now),
+		}
+	}
+
+	if allowed {
+		for i, key := range keys {
+			m.tats[key] = newTATs[i]
+		}
+	}
+	return results
+}
+
+// sweep drops keys whose quota has fully recovered, at most once a minute
+func (m *memoryGCRA) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, tat := range m.tats {
+		if tat.Before(now) {
+			delete(m.tats, key)
+		}
+	}
+}
@@ -1,33 +1,56 @@
 package middleware
 
 import (
-	"net/http"
 	"time"
 
+	"github.com/1827mk/app-server/logger"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"github.com/redis/go-redis/v9"
-	"golang.org/x/time/rate"
+	"go.uber.org/zap"
 )
 
-// RateLimiter returns a middleware that limits the number of requests per minute.
+// RateLimiter returns a middleware that allows each client IP maxRequests
+// per interval, so RateLimiter(rdb, 100, time.Minute) allows 100 requests a
+// minute. Limits are shared across replicas through rdb and kept in memory
+// while Redis is unreachable, or always when rdb is nil. A non-positive
+// interval counts as one minute. A limit NewRateLimiter rejects, such as a
+// non-positive maxRequests, disables limiting.
 func RateLimiter(rdb *redis.Client, maxRequests int64, interval time.Duration) echo.MiddlewareFunc {
-	config := middleware.RateLimiterConfig{
-		Skipper: middleware.DefaultSkipper,
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-			middleware.RateLimiterMemoryStoreConfig{Rate: rate.Limit(maxRequests), Burst: 30, ExpiresIn: interval * time.Minute},
-		),
-		IdentifierExtractor: func(ctx echo.Context) (string, error) {
-			id := ctx.RealIP()
-			return id, nil
-		},
-		ErrorHandler: func(context echo.Context, err error) error {
-			return context.JSON(http.StatusForbidden, nil)
-		},
-		DenyHandler: func(context echo.Context, identifier string, err error) error {
-			return context.JSON(http.StatusTooManyRequests, nil)
-		},
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	limiter, err := NewRateLimiter(rdb, maxRequests, interval)
+	if err != nil {
+		logger.Logger().Error("Rate limiting disabled",
+			zap.Int64("max_requests", maxRequests),
+			zap.Duration("interval", interval),
+			logger.WithError(err),
+		)
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+	return limiter
+}
+
+// NewRateLimiter returns a middleware that allows each client IP
+// maxRequests per period, shared across replicas through rdb. Limits are
+// kept in memory while Redis is unreachable, or always when rdb is nil.
+func NewRateLimiter(rdb *redis.Client, maxRequests int64, period time.Duration) (echo.MiddlewareFunc, error) {
+	store, err := NewRedisRateLimiterStore(rdb, RateLimiterStoreConfig{})
+	if err != nil {
+		return nil, err
+	}
+	policy, err := NewRateLimitPolicy(RateLimitPolicyConfig{
+		Rules: []RateLimitRule{{
+			Name:  "ip",
+			Key:   RateLimitByIP,
+			Limit: Limit{Requests: maxRequests, Period: period},
+		}},
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return middleware.RateLimiterWithConfig(config)
+	return RateLimit(store, policy), nil
 }
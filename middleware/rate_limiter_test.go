@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func serveLimited(t *testing.T, mw echo.MiddlewareFunc, requests int) []*httptest.ResponseRecorder {
+	t.Helper()
+
+	e := echo.New()
+	e.Use(mw)
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	recs := make([]*httptest.ResponseRecorder, requests)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		e.ServeHTTP(recs[i], httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	return recs
+}
+
+func TestRateLimiterUsesIntervalAsPeriod(t *testing.T) {
+	recs := serveLimited(t, RateLimiter(nil, 2, time.Minute), 3)
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i := range want {
+		if recs[i].Code != want[i] {
+			t.Fatalf("request %d: status %d, want %d", i, recs[i].Code, want[i])
+		}
+	}
+
+	// Two requests a minute refill one every 30 seconds
+	retryAfter, err := strconv.Atoi(recs[2].Header().Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > 30 {
+		t.Errorf("Retry-After = %q, want at most 30 seconds", recs[2].Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimiterAcceptsNonPositiveArguments(t *testing.T) {
+	for _, args := range []struct {
+		requests int64
+		interval time.Duration
+	}{{0, time.Minute}, {-1, time.Minute}, {5, 0}, {5, -time.Minute}} {
+		mw := RateLimiter(nil, args.requests, args.interval)
+		if recs := serveLimited(t, mw, 1); recs[0].Code != http.StatusOK {
+			t.Errorf("RateLimiter(%d, %s): status %d", args.requests, args.interval, recs[0].Code)
+		}
+	}
+}
+
+func TestNewRateLimiterRejectsInvalidLimits(t *testing.T) {
+	for _, limit := range []Limit{
+		{Requests: 0, Period: time.Second},
+		{Requests: 10, Period: 0},
+		// Rounds to a zero emission interval
+		{Requests: 10, Period: 5 * time.Nanosecond},
+	} {
+		if _, err := NewRateLimiter(nil, limit.Requests, limit.Period); err == nil {
+			t.Errorf("NewRateLimiter(%d, %s) succeeded", limit.Requests, limit.Period)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrInvalidState is returned for callbacks whose state is unknown,
+	// expired or already used
+	ErrInvalidState = errors.New("invalid or expired oidc state")
+	// ErrStateMismatch is returned for callbacks completed in a browser
+	// other than the one that started the login
+	ErrStateMismatch = errors.New("oidc state does not belong to this browser")
+	// ErrInvalidIDToken is returned when the ID token fails verification
+	ErrInvalidIDToken = errors.New("invalid id token")
+)
+
+// Config identifies the relying party to the provider
+type Config struct {
+	// Issuer is the provider's issuer URL; discovery reads
+	// {Issuer}/.well-known/openid-configuration
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+	// StateTTL is how long a user has to complete the provider login.
+	// Defaults to 10 minutes.
+	StateTTL time.Duration `yaml:"stateTTL"`
+	// Leeway tolerates clock skew when checking ID token times
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+// Discovery is the subset of the provider metadata the flow uses
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// Identity is the verified identity from an ID token
+type Identity struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     bool   `json:"email_verified,omitempty"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	// Claims holds every claim of the ID token
+	Claims map[string]interface{} `json:"-"`
+}
+
+// idTokenClaims are the ID token claims checked during verification
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// pendingLogin is kept in Redis between the redirect and the callback
+type pendingLogin struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to"`
+}
+
+// RelyingParty runs the authorization code flow with PKCE against one
+// provider
+type RelyingParty struct {
+	cfg       Config
+	discovery Discovery
+	keys      *keySet
+	rdb       *redis.Client
+	client    *http.Client
+}
+
+// NewRelyingParty discovers the provider's endpoints. client may be nil to
+// use http.DefaultClient.
+func NewRelyingParty(ctx context.Context, cfg Config, rdb *redis.Client, client *http.Client) (*RelyingParty, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc requires an issuer, client ID and redirect URL")
+	}
+	if rdb == nil {
+		return nil, fmt.Errorf("invalid redis connection")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.StateTTL <= 0 {
+		cfg.StateTTL = 10 * time.Minute
+	}
+
+	discovery, err := discover(ctx, client, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RelyingParty{
+		cfg:       cfg,
+		discovery: *discovery,
+		keys:      newKeySet(discovery.JWKSURI, client),
+		rdb:       rdb,
+		client:    client,
+	}, nil
+}
+
+func discover(ctx context.Context, client *http.Client, issuer string) (*Discovery, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery failed: %s", resp.Status)
+	}
+
+	var d Discovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("failed to decode oidc discovery: %w", err)
+	}
+	// The issuer must match exactly, or tokens from it would not verify
+	if d.Issuer != issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: expected %q, got %q", issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery is missing required endpoints")
+	}
+	return &d, nil
+}
+
+// Discovery returns the provider metadata
+func (rp *RelyingParty) Discovery() Discovery {
+	return rp.discovery
+}
+
+func stateKey(state string) string {
+	return fmt.Sprintf("oidc_state:%s", state)
+}
+
+// StateTTL is how long a started login stays valid
+func (rp *RelyingParty) StateTTL() time.Duration {
+	return rp.cfg.StateTTL
+}
+
+// AuthCodeURL starts a login and returns the provider URL to redirect the
+// user to along with the login's state. The state must be bound to the
+// user's browser, for example in a cookie, and passed to Exchange so that a
+// callback URL cannot be completed by anyone else. returnTo is handed back
+// by Exchange once the login completes.
+func (rp *RelyingParty) AuthCodeURL(ctx context.Context, returnTo string) (authURL, state string, err error) {
+	state, err = randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	pending, err := json.Marshal(pendingLogin{Nonce: nonce, CodeVerifier: verifier, ReturnTo: returnTo})
+	if err != nil {
+		return "", "", err
+	}
+	if err := rp.rdb.Set(ctx, stateKey(state), pending, rp.cfg.StateTTL).Err(); err != nil {
+		return "", "", fmt.Errorf("failed to store oidc state: %w", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.cfg.ClientID},
+		"redirect_uri":          {rp.cfg.RedirectURL},
+		"scope":                 {strings.Join(rp.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(rp.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return rp.discovery.AuthorizationEndpoint + sep + params.Encode(), state, nil
+}
+
+// Exchange completes a login from the callback's state and code.
+// boundState is the state AuthCodeURL returned to this browser; a callback
+// carrying any other state is refused with ErrStateMismatch. It returns the
+// verified identity and the returnTo passed to AuthCodeURL.
+func (rp *RelyingParty) Exchange(ctx context.Context, state, code, boundState string) (*Identity, string, error) {
+	if state == "" || code == "" {
+		return nil, "", ErrInvalidState
+	}
+	// Otherwise a victim could be sent the callback of a login the attacker
+	// started and end up signed in to the attacker's account
+	if subtle.ConstantTimeCompare([]byte(state), []byte(boundState)) != 1 {
+		return nil, "", ErrStateMismatch
+	}
+
+	// Consume the state so a callback URL cannot be replayed
+	raw, err := rp.rdb.GetDel(ctx, stateKey(state)).Bytes()
+	if err == redis.Nil {
+		return nil, "", ErrInvalidState
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load oidc state: %w", err)
+	}
+	var pending pendingLogin
+	if err := json.Unmarshal(raw, &pending); err != nil {
+		return nil, "", ErrInvalidState
+	}
+
+	rawIDToken, err := rp.redeemCode(ctx, code, pending.CodeVerifier)
+	if err != nil {
+		return nil, "", err
+	}
+
+	identity, err := rp.VerifyIDToken(ctx, rawIDToken, pending.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return identity, pending.ReturnTo, nil
+}
+
+// redeemCode exchanges the authorization code for the ID token
+func (rp *RelyingParty) redeemCode(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.cfg.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {rp.cfg.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rp.discovery.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if rp.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(rp.cfg.ClientID), url.QueryEscape(rp.cfg.ClientSecret))
+	}
+
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token request failed: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("oidc token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// VerifyIDToken checks an ID token's signature against the provider's
+// JWKS, its issuer, audience, lifetime and nonce
+func (rp *RelyingParty) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	parser := jwt.NewParser(
+		jwt.WithIssuer(rp.discovery.Issuer),
+		jwt.WithAudience(rp.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(rp.cfg.Leeway),
+		// Asymmetric algorithms only; never trust a provider-chosen HMAC
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}),
+	)
+
+	claims := &idTokenClaims{}
+	if _, err := parser.ParseWithClaims(rawIDToken, claims, rp.keys.keyfunc(ctx)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != rp.cfg.ClientID {
+		return nil, fmt.Errorf("%w: azp mismatch", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	all := map[string]interface{}{}
+	if _, _, err := jwt.NewParser().ParseUnverified(rawIDToken, jwt.MapClaims(all)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	return &Identity{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+		Claims:            all,
+	}, nil
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/1827mk/app-server/oidc/oidctest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testRedirectURL = "http://app.test/auth/oidc/test/callback"
+
+func newTestRelyingParty(t *testing.T) (*RelyingParty, *oidctest.Provider, *miniredis.Miniredis) {
+	t.Helper()
+
+	provider := oidctest.NewProvider("client", "secret")
+	t.Cleanup(provider.Close)
+	mr := miniredis.RunT(t)
+
+	rp, err := NewRelyingParty(context.Background(), Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+	}, redis.NewClient(&redis.Options{Addr: mr.Addr()}), provider.Client())
+	if err != nil {
+		t.Fatalf("NewRelyingParty: %v", err)
+	}
+	return rp, provider, mr
+}
+
+// authorize follows the redirect to the provider and returns the state and
+// code it sends back to the callback
+func authorize(t *testing.T, provider *oidctest.Provider, authURL string) (state, code string) {
+	t.Helper()
+
+	client := provider.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if !strings.HasPrefix(callback.String(), testRedirectURL) {
+		t.Fatalf("authorize: redirected to %s", callback)
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code")
+}
+
+// tamper rewrites the pending login stored for state
+func tamper(t *testing.T, mr *miniredis.Miniredis, state string, change func(*pendingLogin)) {
+	t.Helper()
+
+	raw, err := mr.Get(stateKey(state))
+	if err != nil {
+		t.Fatalf("pending login: %v", err)
+	}
+	var pending pendingLogin
+	if err := json.Unmarshal([]byte(raw), &pending); err != nil {
+		t.Fatalf("pending login: %v", err)
+	}
+	change(&pending)
+	updated, _ := json.Marshal(pending)
+	mr.Set(stateKey(state), string(updated))
+}
+
+func TestLoginFlow(t *testing.T) {
+	rp, provider, _ := newTestRelyingParty(t)
+	provider.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.com", Name: "Alice"})
+	ctx := context.Background()
+
+	authURL, state, err := rp.AuthCodeURL(ctx, "/dashboard")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	callbackState, code := authorize(t, provider, authURL)
+	if callbackState != state {
+		t.Fatalf("callback state %q, want %q", callbackState, state)
+	}
+
+	identity, returnTo, err := rp.Exchange(ctx, callbackState, code, state)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Subject != "alice" || identity.Email != "alice@example.com" || identity.Issuer != provider.Issuer() {
+		t.Errorf("identity = %+v", identity)
+	}
+	if returnTo != "/dashboard" {
+		t.Errorf("returnTo = %q", returnTo)
+	}
+
+	// The state is consumed, so the callback cannot be replayed
+	if _, _, err := rp.Exchange(ctx, callbackState, code, state); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("replayed callback: got %v, want ErrInvalidState", err)
+	}
+}
+
+func TestExchangeRejectsStateOfAnotherBrowser(t *testing.T) {
+	rp, provider, _ := newTestRelyingParty(t)
+	ctx := context.Background()
+
+	// The attacker starts a login and hands the callback to the victim,
+	// whose browser started a login of its own
+	attackerURL, _, err := rp.AuthCodeURL(ctx, "/")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	_, victimState, err := rp.AuthCodeURL(ctx, "/")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	state, code := authorize(t, provider, attackerURL)
+
+	if _, _, err := rp.Exchange(ctx, state, code, victimState); !errors.Is(err, ErrStateMismatch) {
+		t.Errorf("foreign state: got %v, want ErrStateMismatch", err)
+	}
+	if _, _, err := rp.Exchange(ctx, state, code, ""); !errors.Is(err, ErrStateMismatch) {
+		t.Errorf("no bound state: got %v, want ErrStateMismatch", err)
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	rp, provider, mr := newTestRelyingParty(t)
+	ctx := context.Background()
+
+	authURL, state, err := rp.AuthCodeURL(ctx, "/")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	_, code := authorize(t, provider, authURL)
+	tamper(t, mr, state, func(p *pendingLogin) { p.CodeVerifier = "not-the-verifier" })
+
+	_, _, err = rp.Exchange(ctx, state, code, state)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("wrong verifier: got %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	rp, provider, mr := newTestRelyingParty(t)
+	ctx := context.Background()
+
+	authURL, state, err := rp.AuthCodeURL(ctx, "/")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	_, code := authorize(t, provider, authURL)
+	tamper(t, mr, state, func(p *pendingLogin) { p.Nonce = "another-nonce" })
+
+	if _, _, err := rp.Exchange(ctx, state, code, state); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("wrong nonce: got %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsOtherAudience(t *testing.T) {
+	rp, provider, _ := newTestRelyingParty(t)
+
+	token, err := provider.IDToken(oidctest.User{Subject: "alice"}, "n", map[string]interface{}{"aud": "other"})
+	if err != nil {
+		t.Fatalf("IDToken: %v", err)
+	}
+	if _, err := rp.VerifyIDToken(context.Background(), token, "n"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("other audience: got %v, want ErrInvalidIDToken", err)
+	}
+}
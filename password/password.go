@@ -0,0 +1,241 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported hashing algorithms
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrInvalidHash is returned for encoded hashes that cannot be parsed
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Argon2Params are the argon2id cost parameters
+type Argon2Params struct {
+	Memory      uint32 `yaml:"memory"` // KiB
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+	SaltLength  uint32 `yaml:"saltLength"`
+	KeyLength   uint32 `yaml:"keyLength"`
+}
+
+// DefaultArgon2Params follow the RFC 9106 recommendation for memory
+// constrained environments
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Hasher hashes new passwords with one algorithm and verifies hashes made
+// with any supported algorithm
+type Hasher struct {
+	Algorithm  string       `yaml:"algorithm"`
+	Argon2     Argon2Params `yaml:"argon2"`
+	BcryptCost int          `yaml:"bcryptCost"`
+}
+
+// NewHasher returns a Hasher using argon2id with the default parameters
+func NewHasher() *Hasher {
+	return &Hasher{
+		Algorithm:  Argon2id,
+		Argon2:     DefaultArgon2Params,
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+var defaultHasher = NewHasher()
+
+// Hash hashes password with the default hasher
+func Hash(password string) (string, error) {
+	return defaultHasher.Hash(password)
+}
+
+// Verify checks password against an encoded hash with the default hasher
+func Verify(password, encoded string) (bool, error) {
+	return defaultHasher.Verify(password, encoded)
+}
+
+// Hash returns the encoded hash of password. Argon2id hashes use the PHC
+// string format; bcrypt hashes use bcrypt's own modular crypt format.
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id, "":
+		return h.hashArgon2id(password)
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost())
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unsupported password algorithm: %s", h.Algorithm)
+	}
+}
+
+// Verify reports whether password matches the encoded hash in constant time
+func (h *Hasher) Verify(password, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+		}
+		return true, nil
+	default:
+		return false, ErrInvalidHash
+	}
+}
+
+// NeedsRehash reports whether encoded was made with a different algorithm
+// or weaker parameters than the hasher's current settings
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	switch h.Algorithm {
+	case Argon2id, "":
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return true
+		}
+		want := h.argon2Params()
+		return params.Memory != want.Memory ||
+			params.Iterations != want.Iterations ||
+			params.Parallelism != want.Parallelism ||
+			uint32(len(salt)) != want.SaltLength ||
+			uint32(len(key)) != want.KeyLength
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != h.bcryptCost()
+	default:
+		return false
+	}
+}
+
+// VerifyAndRehash checks password and, when it matches a hash that needs
+// upgrading, also returns a fresh hash to store in its place
+func (h *Hasher) VerifyAndRehash(password, encoded string) (ok bool, rehashed string, err error) {
+	ok, err = h.Verify(password, encoded)
+	if err != nil || !ok {
+		return ok, "", err
+	}
+	if !h.NeedsRehash(encoded) {
+		return true, "", nil
+	}
+	rehashed, err = h.Hash(password)
+	if err != nil {
+		return true, "", err
+	}
+	return true, rehashed, nil
+}
+
+// argon2Params returns the hasher's argon2id parameters with unset ones
+// taken from DefaultArgon2Params, so a configuration naming only the
+// algorithm still hashes
+func (h *Hasher) argon2Params() Argon2Params {
+	p := h.Argon2
+	if p.Memory == 0 {
+		p.Memory = DefaultArgon2Params.Memory
+	}
+	if p.Iterations == 0 {
+		p.Iterations = DefaultArgon2Params.Iterations
+	}
+	if p.Parallelism == 0 {
+		p.Parallelism = DefaultArgon2Params.Parallelism
+	}
+	if p.SaltLength == 0 {
+		p.SaltLength = DefaultArgon2Params.SaltLength
+	}
+	if p.KeyLength == 0 {
+		p.KeyLength = DefaultArgon2Params.KeyLength
+	}
+	return p
+}
+
+// bcryptCost returns the hasher's bcrypt cost, or bcrypt.DefaultCost when
+// it is unset or below bcrypt.MinCost, as GenerateFromPassword would use
+func (h *Hasher) bcryptCost() int {
+	if h.BcryptCost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return h.BcryptCost
+}
+
+func (h *Hasher) hashArgon2id(password string) (string, error) {
+	p := h.argon2Params()
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported argon2 version", ErrInvalidHash)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	// argon2.IDKey panics on zero iterations or parallelism, and hashes
+	// reach here straight from login attempts
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, fmt.Errorf("%w: zero cost parameter", ErrInvalidHash)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
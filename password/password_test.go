@@ -0,0 +1,66 @@
+package password
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasherWithoutArgon2ParamsUsesDefaults(t *testing.T) {
+	h := &Hasher{Algorithm: Argon2id}
+
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	ok, err := h.Verify("correct horse", encoded)
+	if err != nil || !ok {
+		t.Fatalf("Verify = %v, %v", ok, err)
+	}
+	if h.NeedsRehash(encoded) {
+		t.Error("fresh hash needs rehash")
+	}
+	if NewHasher().NeedsRehash(encoded) {
+		t.Error("hash differs from the default parameters")
+	}
+}
+
+func TestVerifyRejectsZeroCostHashes(t *testing.T) {
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=0,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$",
+	} {
+		ok, err := Verify("password", encoded)
+		if ok || !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Verify(%q) = %v, %v; want ErrInvalidHash", encoded, ok, err)
+		}
+	}
+}
+
+func TestHasherWithoutBcryptCostUsesDefault(t *testing.T) {
+	h := &Hasher{Algorithm: Bcrypt}
+
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("cost = %d, %v; want %d", cost, err, bcrypt.DefaultCost)
+	}
+	if h.NeedsRehash(encoded) {
+		t.Error("fresh hash needs rehash")
+	}
+	ok, rehashed, err := h.VerifyAndRehash("correct horse", encoded)
+	if err != nil || !ok || rehashed != "" {
+		t.Errorf("VerifyAndRehash = %v, %q, %v; want no rehash", ok, rehashed, err)
+	}
+
+	stronger := &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.DefaultCost + 1}
+	if !stronger.NeedsRehash(encoded) {
+		t.Error("hash at the default cost satisfies a higher cost")
+	}
+}
@@ -0,0 +1,115 @@
+package password
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/1827mk/app-server/datastore"
+)
+
+// Schema creates the table used by Repository
+const Schema = `
+CREATE TABLE IF NOT EXISTS user_credentials (
+	user_id       BIGINT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// Repository stores password hashes in Postgres and upgrades them
+// transparently when a user signs in
+type Repository struct {
+	store  datastore.Store
+	hasher *Hasher
+
+	// dummyHash is verified for unknown users so that response times do
+	// not reveal which users exist
+	dummyHash string
+}
+
+// NewRepository creates a credential repository on the store's connection.
+// A nil hasher uses argon2id with the default parameters.
+func NewRepository(store datastore.Store, hasher *Hasher) (*Repository, error) {
+	if store == nil || store.GetDB() == nil {
+		return nil, fmt.Errorf("invalid database connection")
+	}
+	if hasher == nil {
+		hasher = NewHasher()
+	}
+
+	dummyHash, err := hasher.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository{store: store, hasher: hasher, dummyHash: dummyHash}, nil
+}
+
+// SetPassword hashes and stores a user's password, replacing any previous one
+func (r *Repository) SetPassword(ctx context.Context, userID uint, password string) error {
+	hash, err := r.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.store.GetDB().ExecContext(ctx, `
+		INSERT INTO user_credentials (user_id, password_hash, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (user_id) DO UPDATE
+		SET password_hash = EXCLUDED.password_hash, updated_at = now()`,
+		userID, hash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store password: %w", err)
+	}
+	return nil
+}
+
+// Verify checks a user's password. When it matches a hash made with an
+// older algorithm or weaker parameters, the stored hash is upgraded.
+// Users without a password never verify.
+func (r *Repository) Verify(ctx context.Context, userID uint, password string) (bool, error) {
+	var hash string
+	err := r.store.GetDB().QueryRowContext(ctx,
+		`SELECT password_hash FROM user_credentials WHERE user_id = $1`, userID,
+	).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, _ = r.hasher.Verify(password, r.dummyHash)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load password: %w", err)
+	}
+
+	ok, rehashed, err := r.hasher.VerifyAndRehash(password, hash)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	if rehashed != "" {
+		// Only replace the hash we verified, in case the password changed meanwhile
+		_, err = r.store.GetDB().ExecContext(ctx, `
+			UPDATE user_credentials
+			SET password_hash = $1, updated_at = now()
+			WHERE user_id = $2 AND password_hash = $3`,
+			rehashed, userID, hash,
+		)
+		if err != nil {
+			return true, fmt.Errorf("failed to upgrade password hash: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Delete removes a user's password
+func (r *Repository) Delete(ctx context.Context, userID uint) error {
+	_, err := r.store.GetDB().ExecContext(ctx,
+		`DELETE FROM user_credentials WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete password: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// flushBatch is how many counters are taken from the dirty set at a time
+const flushBatch = 100
+
+// finalFlushTimeout bounds the flush Stop makes, which runs even when the
+// context given to Stop is done
+const finalFlushTimeout = 10 * time.Second
+
+// run flushes usage until Stop is called
+func (m *Meter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Flush(context.Background()); err != nil {
+				logger.Logger().Error("Failed to flush quota usage", logger.WithError(err))
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Stop ends periodic flushing and flushes the remaining usage. ctx bounds
+// the wait for a periodic flush in progress; the last flush always runs,
+// for up to ten seconds, so a slow shutdown does not lose usage.
+func (m *Meter) Stop(ctx context.Context) error {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+
+	var waitErr error
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		// Flushes may overlap: each counter is popped by one of them
+		waitErr = ctx.Err()
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+	defer cancel()
+	if err := m.Flush(flushCtx); err != nil {
+		return err
+	}
+	return waitErr
+}
+
+// Flush writes the counters changed since the last flush to the
+// quota_usage table. Totals are written rather than increments, so a
+// counter flushed twice is not double counted.
+func (m *Meter) Flush(ctx context.Context) error {
+	for {
+		// Popping before reading means a request counted meanwhile marks
+		// its counter dirty again and is picked up by the next flush
+		members, err := m.rdb.SPopN(ctx, dirtyKey, flushBatch).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read changed usage: %w", err)
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		for i, member := range members {
+			if err := m.flushCounter(ctx, member); err != nil {
+				// Keep what was not written for the next flush
+				remaining := make([]interface{}, 0, len(members)-i)
+				for _, member := range members[i:] {
+					remaining = append(remaining, member)
+				}
+				if err := m.rdb.SAdd(ctx, dirtyKey, remaining...).Err(); err != nil {
+					logger.Logger().Error("Failed to requeue quota usage", logger.WithError(err))
+				}
+				return err
+			}
+		}
+	}
+}
+
+func (m *Meter) flushCounter(ctx context.Context, member string) error {
+	parts := strings.SplitN(member, "|", 3)
+	if len(parts) != 3 {
+		// Not ours; drop it
+		return nil
+	}
+	period, start, identity := parts[0], parts[1], parts[2]
+
+	value, err := m.rdb.Get(ctx, counterKey(member)).Result()
+	if err == redis.Nil {
+		// Expired before it could be flushed; the last flush stands
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage counter: %w", err)
+	}
+	requests, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	_, err = m.store.GetDB().ExecContext(ctx, `
+		INSERT INTO quota_usage (identity, period, period_start, requests, updated_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (identity, period, period_start) DO UPDATE
+		SET requests = GREATEST(quota_usage.requests, EXCLUDED.requests),
+			updated_at = now()`,
+		identity, period, start, requests,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store quota usage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package quota
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Middleware meters requests of authenticated callers by user and refuses
+// them with 429 once a hard quota is used up. Use it after the
+// authentication middleware. Anonymous requests are not metered.
+func (m *Meter) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, ok := appmiddleware.ClaimsFromContext(c)
+			if !ok || claims.UserID == 0 {
+				return next(c)
+			}
+
+			usage, err := m.Record(c.Request().Context(), UserIdentity(claims.UserID), claims.Plan)
+			if errors.Is(err, ErrQuotaExceeded) {
+				return quotaExceeded(c, usage)
+			}
+			if err != nil {
+				// Metering must not take the API down with it
+				logger.Logger().Error("Failed to meter request",
+					zap.Uint("user_id", claims.UserID),
+					logger.WithError(err),
+				)
+			}
+			return next(c)
+		}
+	}
+}
+
+func quotaExceeded(c echo.Context, usage *Usage) error {
+	message, resetsAt := "The daily request quota is used up", usage.Day.ResetsAt
+	if usage.Month.HardExceeded() {
+		message, resetsAt = "The monthly request quota is used up", usage.Month.ResetsAt
+	}
+	retryAfter := int64(time.Until(resetsAt)/time.Second) + 1
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+
+	return c.JSON(http.StatusTooManyRequests, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":      "quota_exceeded",
+			"message":   message,
+			"resets_at": resetsAt.UTC().Format(time.RFC3339),
+		}},
+		Message: "Quota exceeded",
+	})
+}
@@ -0,0 +1,277 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/1827mk/app-server/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ErrQuotaExceeded is returned by Record when a hard quota is used up
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Schema creates the table Flush writes usage to
+const Schema = `
+CREATE TABLE IF NOT EXISTS quota_usage (
+	identity     TEXT NOT NULL,
+	period       TEXT NOT NULL,
+	period_start DATE NOT NULL,
+	requests     BIGINT NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (identity, period, period_start)
+);
+`
+
+// Periods usage is counted over
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// dirtyKey lists the counters changed since the last flush
+const dirtyKey = "quota_dirty"
+
+// Counters outlive their period long enough to be flushed
+const (
+	dayCounterTTL   = 3 * 24 * time.Hour
+	monthCounterTTL = 62 * 24 * time.Hour
+)
+
+// Limit bounds the requests of one period. Zero disables either bound.
+type Limit struct {
+	// Soft is the usage past which requests are still served but the
+	// identity is reported through Config.OnSoftLimit
+	Soft int64 `yaml:"soft"`
+	// Hard is the usage at which requests are refused until the period ends
+	Hard int64 `yaml:"hard"`
+}
+
+// Plan holds the quotas of a billing plan
+type Plan struct {
+	Daily   Limit `yaml:"daily"`
+	Monthly Limit `yaml:"monthly"`
+}
+
+// Config declares the quota plans
+type Config struct {
+	// Plans maps plan names, as carried in the plan claim, to their quotas.
+	// Identities on unknown plans are metered without limits. Plan names are
+	// case insensitive, as config loaders such as viper lowercase map keys.
+	Plans map[string]Plan `yaml:"plans"`
+	// DefaultPlan is the plan of identities that name none
+	DefaultPlan string `yaml:"defaultPlan"`
+	// FlushInterval is how often usage is written to Postgres. Defaults to
+	// one minute.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// Location decides where calendar days and months begin. Defaults to UTC.
+	Location *time.Location `yaml:"-"`
+	// OnSoftLimit is called once per period when an identity passes a soft
+	// quota
+	OnSoftLimit func(usage *Usage) `yaml:"-"`
+}
+
+// PeriodUsage is the usage of one day or month
+type PeriodUsage struct {
+	Start    time.Time `json:"start"`
+	ResetsAt time.Time `json:"resets_at"`
+	Used     int64     `json:"used"`
+	Soft     int64     `json:"soft_limit,omitempty"`
+	Hard     int64     `json:"hard_limit,omitempty"`
+}
+
+// SoftExceeded reports whether usage is past the soft quota
+func (p PeriodUsage) SoftExceeded() bool {
+	return p.Soft > 0 && p.Used > p.Soft
+}
+
+// HardExceeded reports whether the hard quota is used up
+func (p PeriodUsage) HardExceeded() bool {
+	return p.Hard > 0 && p.Used >= p.Hard
+}
+
+// Usage is an identity's current usage
+type Usage struct {
+	Identity string      `json:"identity"`
+	Plan     string      `json:"plan,omitempty"`
+	Day      PeriodUsage `json:"day"`
+	Month    PeriodUsage `json:"month"`
+}
+
+// recordScript counts a request against the day and month counters unless
+// a hard quota is used up. Denied requests are not counted.
+// Returns {allowed, day, month}.
+var recordScript = redis.NewScript(`
+local day = tonumber(redis.call('GET', KEYS[1]) or '0')
+local month = tonumber(redis.call('GET', KEYS[2]) or '0')
+local day_hard = tonumber(ARGV[1])
+local month_hard = tonumber(ARGV[2])
+if (day_hard > 0 and day >= day_hard) or (month_hard > 0 and month >= month_hard) then
+	return {0, day, month}
+end
+
+day = redis.call('INCR', KEYS[1])
+if day == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+end
+month = redis.call('INCR', KEYS[2])
+if month == 1 then
+	redis.call('EXPIRE', KEYS[2], ARGV[4])
+end
+redis.call('SADD', KEYS[3], ARGV[5], ARGV[6])
+return {1, day, month}
+`)
+
+// Meter counts requests per identity per calendar day and month in Redis
+// and periodically flushes the totals to Postgres for reporting
+type Meter struct {
+	store datastore.Store
+	rdb   *redis.Client
+	cfg   Config
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMeter creates a meter and starts flushing usage every
+// cfg.FlushInterval. Call Stop to flush one last time and stop.
+func NewMeter(store datastore.Store, rdb *redis.Client, cfg Config) (*Meter, error) {
+	if store == nil || store.GetDB() == nil {
+		return nil, fmt.Errorf("invalid database connection")
+	}
+	if rdb == nil {
+		return nil, fmt.Errorf("invalid redis connection")
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Minute
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	plans := make(map[string]Plan, len(cfg.Plans))
+	for name, plan := range cfg.Plans {
+		if _, ok := plans[strings.ToLower(name)]; ok {
+			return nil, fmt.Errorf("duplicate quota plan %q", name)
+		}
+		plans[strings.ToLower(name)] = plan
+	}
+	cfg.Plans = plans
+
+	m := &Meter{
+		store: store,
+		rdb:   rdb,
+		cfg:   cfg,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+// UserIdentity is the identity requests of an authenticated user are
+// metered under
+func UserIdentity(userID uint) string {
+	return "user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+// periods returns the current day and month usage windows
+func (m *Meter) periods(now time.Time) (day, month PeriodUsage) {
+	now = now.In(m.cfg.Location)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, m.cfg.Location)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, m.cfg.Location)
+	day = PeriodUsage{Start: dayStart, ResetsAt: dayStart.AddDate(0, 0, 1)}
+	month = PeriodUsage{Start: monthStart, ResetsAt: monthStart.AddDate(0, 1, 0)}
+	return day, month
+}
+
+// usage prepares the usage of identity on plan, without counts
+func (m *Meter) usage(identity, plan string, now time.Time) *Usage {
+	if plan == "" {
+		plan = m.cfg.DefaultPlan
+	}
+	limits := m.cfg.Plans[strings.ToLower(plan)]
+
+	day, month := m.periods(now)
+	day.Soft, day.Hard = limits.Daily.Soft, limits.Daily.Hard
+	month.Soft, month.Hard = limits.Monthly.Soft, limits.Monthly.Hard
+	return &Usage{Identity: identity, Plan: plan, Day: day, Month: month}
+}
+
+// member names a counter in the dirty set as period|start|identity
+func member(period string, start time.Time, identity string) string {
+	return period + "|" + start.Format("2006-01-02") + "|" + identity
+}
+
+func counterKey(member string) string {
+	return "quota:" + member
+}
+
+// Record counts one request by identity. When a hard quota is used up the
+// request is not counted and ErrQuotaExceeded is returned along with the
+// usage.
+func (m *Meter) Record(ctx context.Context, identity, plan string) (*Usage, error) {
+	usage := m.usage(identity, plan, time.Now())
+	dayMember := member(PeriodDay, usage.Day.Start, identity)
+	monthMember := member(PeriodMonth, usage.Month.Start, identity)
+
+	result, err := recordScript.Run(ctx, m.rdb,
+		[]string{counterKey(dayMember), counterKey(monthMember), dirtyKey},
+		usage.Day.Hard, usage.Month.Hard,
+		int(dayCounterTTL/time.Second), int(monthCounterTTL/time.Second),
+		dayMember, monthMember,
+	).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record usage: %w", err)
+	}
+
+	usage.Day.Used, usage.Month.Used = result[1], result[2]
+	if result[0] == 0 {
+		return usage, ErrQuotaExceeded
+	}
+
+	// Report each soft quota once, on the request that passes it
+	if (usage.Day.Soft > 0 && usage.Day.Used == usage.Day.Soft+1) ||
+		(usage.Month.Soft > 0 && usage.Month.Used == usage.Month.Soft+1) {
+		logger.Logger().Info("Soft quota exceeded",
+			zap.String("identity", identity),
+			zap.String("plan", usage.Plan),
+			zap.Int64("day", usage.Day.Used),
+			zap.Int64("month", usage.Month.Used),
+		)
+		if m.cfg.OnSoftLimit != nil {
+			m.cfg.OnSoftLimit(usage)
+		}
+	}
+	return usage, nil
+}
+
+// Usage returns identity's usage in the current day and month, with the
+// quotas of plan
+func (m *Meter) Usage(ctx context.Context, identity, plan string) (*Usage, error) {
+	usage := m.usage(identity, plan, time.Now())
+
+	values, err := m.rdb.MGet(ctx,
+		counterKey(member(PeriodDay, usage.Day.Start, identity)),
+		counterKey(member(PeriodMonth, usage.Month.Start, identity)),
+	).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			if counts[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid usage counter %q", s)
+			}
+		}
+	}
+	usage.Day.Used, usage.Month.Used = counts[0], counts[1]
+	return usage, nil
+}
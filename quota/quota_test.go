@@ -0,0 +1,153 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestMeter builds a meter on an in-memory Redis. Its database cannot
+// be reached, so flushing counters fails.
+func newTestMeter(t *testing.T, cfg Config) *Meter {
+	t.Helper()
+
+	db, err := sql.Open("postgres", "host=/nonexistent sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Hour
+	}
+	m, err := NewMeter(&datastore.DBStore{DB: db}, rdb, cfg)
+	if err != nil {
+		t.Fatalf("NewMeter: %v", err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-m.stop:
+		default:
+			close(m.stop)
+		}
+	})
+	return m
+}
+
+func TestRecordEnforcesQuotas(t *testing.T) {
+	var reported []*Usage
+	m := newTestMeter(t, Config{
+		Plans: map[string]Plan{
+			"Free": {Daily: Limit{Soft: 2, Hard: 3}},
+		},
+		OnSoftLimit: func(usage *Usage) { reported = append(reported, usage) },
+	})
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		usage, err := m.Record(ctx, "user:1", "free")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if usage.Day.Used != int64(i) || usage.Month.Used != int64(i) {
+			t.Fatalf("request %d: usage = %+v", i, usage)
+		}
+	}
+	if len(reported) != 1 || reported[0].Day.Used != 3 {
+		t.Errorf("soft limit reported %d times", len(reported))
+	}
+
+	usage, err := m.Record(ctx, "user:1", "free")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("request past the hard quota: got %v, want ErrQuotaExceeded", err)
+	}
+	if !usage.Day.HardExceeded() || usage.Day.Used != 3 {
+		t.Errorf("denied request was counted: %+v", usage.Day)
+	}
+
+	// Other identities and unknown plans are unaffected
+	if _, err := m.Record(ctx, "user:2", "free"); err != nil {
+		t.Errorf("other identity: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := m.Record(ctx, "user:3", "enterprise"); err != nil {
+			t.Fatalf("unknown plan: %v", err)
+		}
+	}
+
+	current, err := m.Usage(ctx, "user:1", "free")
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if current.Day.Used != 3 || current.Day.Hard != 3 || current.Day.Soft != 2 {
+		t.Errorf("Usage = %+v", current.Day)
+	}
+}
+
+func TestPeriodsFollowCalendarInLocation(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	m := newTestMeter(t, Config{Location: tokyo})
+
+	for _, tc := range []struct {
+		at                    time.Time
+		day, dayEnd, monthEnd time.Time
+	}{
+		{
+			// 2026-12-31 23:30 in Tokyo is still the 31st there
+			at:       time.Date(2026, 12, 31, 14, 30, 0, 0, time.UTC),
+			day:      time.Date(2026, 12, 31, 0, 0, 0, 0, tokyo),
+			dayEnd:   time.Date(2027, 1, 1, 0, 0, 0, 0, tokyo),
+			monthEnd: time.Date(2027, 1, 1, 0, 0, 0, 0, tokyo),
+		},
+		{
+			// Half an hour later it is the new year there
+			at:       time.Date(2026, 12, 31, 15, 0, 0, 0, time.UTC),
+			day:      time.Date(2027, 1, 1, 0, 0, 0, 0, tokyo),
+			dayEnd:   time.Date(2027, 1, 2, 0, 0, 0, 0, tokyo),
+			monthEnd: time.Date(2027, 2, 1, 0, 0, 0, 0, tokyo),
+		},
+		{
+			at:       time.Date(2028, 2, 29, 12, 0, 0, 0, tokyo),
+			day:      time.Date(2028, 2, 29, 0, 0, 0, 0, tokyo),
+			dayEnd:   time.Date(2028, 3, 1, 0, 0, 0, 0, tokyo),
+			monthEnd: time.Date(2028, 3, 1, 0, 0, 0, 0, tokyo),
+		},
+	} {
+		day, month := m.periods(tc.at)
+		if !day.Start.Equal(tc.day) || !day.ResetsAt.Equal(tc.dayEnd) {
+			t.Errorf("%s: day = %s to %s", tc.at, day.Start, day.ResetsAt)
+		}
+		if !month.ResetsAt.Equal(tc.monthEnd) || month.Start.Day() != 1 {
+			t.Errorf("%s: month = %s to %s", tc.at, month.Start, month.ResetsAt)
+		}
+	}
+}
+
+func TestStopFlushesAfterContextExpires(t *testing.T) {
+	m := newTestMeter(t, Config{})
+	if _, err := m.Record(context.Background(), "user:1", ""); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The database is unreachable, so a flush that ran fails with a store
+	// error rather than the expired context
+	err := m.Stop(ctx)
+	if err == nil || errors.Is(err, context.Canceled) {
+		t.Fatalf("Stop = %v, want the flush to have run", err)
+	}
+	pending, err := m.rdb.SCard(context.Background(), dirtyKey).Result()
+	if err != nil || pending != 2 {
+		t.Errorf("dirty counters = %d, %v; want both requeued", pending, err)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/1827mk/app-server/apikey"
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// APIKeyHeader carries an API key on /api requests
+const APIKeyHeader = "X-API-Key"
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type createAPIKeyResponse struct {
+	// Plaintext is the key itself, shown only once
+	Plaintext string `json:"key"`
+	*apikey.Key
+}
+
+// apiKeyOr authenticates requests carrying an X-API-Key header by their key,
+// and every other request with the bearer token middleware chain
+func (s *Server) apiKeyOr(bearer ...echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		viaBearer := next
+		for i := len(bearer) - 1; i >= 0; i-- {
+			viaBearer = bearer[i](viaBearer)
+		}
+
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(APIKeyHeader)
+			if key == "" {
+				return viaBearer(c)
+			}
+
+			claims, err := s.authenticateAPIKey(c.Request().Context(), key)
+			if errors.Is(err, apikey.ErrInvalidKey) || errors.Is(err, apikey.ErrKeyExpired) {
+				logger.SecurityEvent("api_key_rejected",
+					zap.String("ip", c.RealIP()),
+					zap.String("route", c.Path()),
+					logger.WithError(err),
+				)
+				return unauthorized(c, err)
+			}
+			if err != nil {
+				return serviceUnavailable(c, err)
+			}
+
+			c.Set(appmiddleware.ClaimsContextKey, claims)
+			return next(c)
+		}
+	}
+}
+
+// authenticateAPIKey resolves a key into the claims handlers see for bearer
+// tokens. The key's scopes become the permissions and the owner's role is
+// dropped, so a key can never do more than it was issued for.
+func (s *Server) authenticateAPIKey(ctx context.Context, plaintext string) (Claims, error) {
+	key, err := s.APIKeys.Authenticate(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := s.newClaims()
+	if s.loadKeyOwner != nil {
+		// Keys stop working along with their owner's account
+		if claims, err = s.loadKeyOwner(ctx, key.UserID); err != nil {
+			return nil, fmt.Errorf("%w: failed to load owner: %w", apikey.ErrInvalidKey, err)
+		}
+	}
+
+	base := claims.Base()
+	base.UserID = key.UserID
+	base.Role = ""
+	base.Permissions = key.Scopes
+	base.TokenType = appmiddleware.TokenTypeAPIKey
+	base.RegisteredClaims = jwt.RegisteredClaims{
+		Subject: base.Subject,
+		ID:      key.ID,
+	}
+	if key.ExpiresAt != nil {
+		base.ExpiresAt = jwt.NewNumericDate(*key.ExpiresAt)
+	}
+	return claims, nil
+}
+
+// mountAPIKeys registers the endpoints users manage their keys with
+func (h *AuthHandlers) mountAPIKeys(g *echo.Group) {
+	requireAccessToken := h.server.requireAccessToken
+	g.GET("/api-keys", h.ListAPIKeys, requireAccessToken...)
+	g.POST("/api-keys", h.CreateAPIKey, requireAccessToken...)
+	g.DELETE("/api-keys/:id", h.RevokeAPIKey, requireAccessToken...)
+}
+
+// ListAPIKeys returns the caller's active keys. Like the other key
+// endpoints it refuses API keys and impersonating callers.
+func (h *AuthHandlers) ListAPIKeys(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if claims.TokenType == appmiddleware.TokenTypeAPIKey {
+		return authError(c, http.StatusForbidden, "forbidden", "API keys cannot list API keys")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	keys, err := h.server.APIKeys.List(c.Request().Context(), claims.UserID)
+	if err != nil {
+		logger.Logger().Error("Failed to list API keys", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Failed to list API keys")
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey issues a key for the caller. Keys may only carry scopes the
+// caller holds, and cannot be created with another API key or while
+// impersonating.
+func (h *AuthHandlers) CreateAPIKey(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if claims.TokenType == appmiddleware.TokenTypeAPIKey {
+		return authError(c, http.StatusForbidden, "forbidden", "API keys cannot create API keys")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	var req createAPIKeyRequest
+	if err := c.Bind(&req); err != nil || req.Name == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Name is required")
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Expiry must be in the future")
+	}
+	if !appmiddleware.HasPermission(req.Scopes...)(claims, h.server.policy) {
+		return authError(c, http.StatusForbidden, "forbidden", "You cannot grant scopes you do not hold")
+	}
+
+	plaintext, key, err := h.server.APIKeys.Issue(c.Request().Context(),
+		claims.UserID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		logger.Logger().Error("Failed to issue API key", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Failed to create API key")
+	}
+
+	logger.SecurityEvent("api_key_created",
+		zap.Uint("user_id", claims.UserID),
+		zap.String("key_id", key.ID),
+		zap.Strings("scopes", key.Scopes),
+	)
+	return c.JSON(http.StatusCreated, createAPIKeyResponse{Plaintext: plaintext, Key: key})
+}
+
+// RevokeAPIKey disables one of the caller's keys. It cannot be called with
+// an API key or while impersonating.
+func (h *AuthHandlers) RevokeAPIKey(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if claims.TokenType == appmiddleware.TokenTypeAPIKey {
+		return authError(c, http.StatusForbidden, "forbidden", "API keys cannot revoke API keys")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	id := c.Param("id")
+	err := h.server.APIKeys.Revoke(c.Request().Context(), claims.UserID, id)
+	if errors.Is(err, apikey.ErrInvalidKey) {
+		return authError(c, http.StatusNotFound, "not_found", "API key not found")
+	}
+	if err != nil {
+		logger.Logger().Error("Failed to revoke API key", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Failed to revoke API key")
+	}
+
+	logger.SecurityEvent("api_key_revoked",
+		zap.Uint("user_id", claims.UserID),
+		zap.String("key_id", id),
+	)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAPIKeyEndpointsRefuseDelegatedCallers(t *testing.T) {
+	h := &AuthHandlers{server: newTestServer(t)}
+	e := echo.New()
+
+	callers := map[string]*JWTClaims{
+		"api key":       {UserID: 1, TokenType: appmiddleware.TokenTypeAPIKey},
+		"impersonation": {UserID: 1, TokenType: appmiddleware.TokenTypeAccess, Act: &Actor{UserID: 2}},
+		"certificate":   {Username: "billing", TokenType: appmiddleware.TokenTypeClientCert},
+		"no user":       {TokenType: appmiddleware.TokenTypeAccess},
+	}
+	handlers := map[string]echo.HandlerFunc{
+		"list":   h.ListAPIKeys,
+		"create": h.CreateAPIKey,
+		"revoke": h.RevokeAPIKey,
+	}
+
+	for caller, claims := range callers {
+		for name, handler := range handlers {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+			c.Set(appmiddleware.ClaimsContextKey, claims)
+			if err := handler(c); err != nil {
+				t.Fatalf("%s by %s: %v", name, caller, err)
+			}
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s by %s: status %d, want 403", name, caller, rec.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/1827mk/app-server/mfa"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Cookie names used when AuthOptions.Cookies is enabled
+const (
+	accessTokenCookie  = "access_token"
+	refreshTokenCookie = "refresh_token"
+)
+
+// ErrInvalidCredentials is returned by a UserAuthenticator when the
+// username or password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// UserAuthenticator connects the built-in auth endpoints to the
+// application's users
+type UserAuthenticator interface {
+	// Authenticate checks a username and password and returns the user's
+	// claims, or ErrInvalidCredentials
+	Authenticate(ctx context.Context, username, password string) (Claims, error)
+	// LoadUser returns the current claims of a user. It is called on every
+	// refresh and should fail for users who may no longer sign in.
+	LoadUser(ctx context.Context, userID uint) (Claims, error)
+}
+
+// AuthOptions configures the built-in auth endpoints
+type AuthOptions struct {
+	// Prefix is where the endpoints are mounted. Defaults to /auth.
+	Prefix string
+	// Cookies delivers tokens in HttpOnly cookies instead of the response
+	// body, for browser clients
+	Cookies bool
+	// CookieDomain sets the Domain attribute of the token cookies
+	CookieDomain string
+	// CookieSameSite defaults to http.SameSiteStrictMode
+	CookieSameSite http.SameSite
+	// InsecureCookies drops the Secure attribute, for local development over HTTP
+	InsecureCookies bool
+	// Guard throttles failed logins. Defaults to a guard using the auth
+	// rate limit configuration.
+	Guard *appmiddleware.LoginGuard
+	// MFA enables TOTP second factors. Users who enrolled receive an MFA
+	// pending token from login instead of a token pair.
+	MFA *mfa.Manager
+	// Impersonate lets callers who satisfy it obtain a token acting as
+	// another user. Nil disables impersonation.
+	Impersonate appmiddleware.Requirement
+	// ImpersonationExpiry is the lifetime of impersonation tokens.
+	// Defaults to 15 minutes.
+	ImpersonationExpiry time.Duration
+	// Introspect lets callers who satisfy it inspect tokens. Nil disables
+	// introspection.
+	Introspect appmiddleware.Requirement
+}
+
+// AuthHandlers serves the built-in login, refresh, logout and me endpoints
+type AuthHandlers struct {
+	server *Server
+	authn  UserAuthenticator
+	opts   AuthOptions
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DeviceID string `json:"device_id"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	// All ends every session of the user, not just this device's, and
+	// revokes every access token issued to them
+	All bool `json:"all"`
+}
+
+// MountAuth registers POST {prefix}/login, POST {prefix}/refresh,
+// POST {prefix}/logout and GET {prefix}/me, plus the {prefix}/mfa/*
+// endpoints when MFA is configured, the {prefix}/api-keys endpoints when
+// API keys are enabled, and POST {prefix}/impersonate and
+// POST {prefix}/introspect when their requirements are set
+func (s *Server) MountAuth(authn UserAuthenticator, opts AuthOptions) *AuthHandlers {
+	if opts.Prefix == "" {
+		opts.Prefix = "/auth"
+	}
+	if opts.CookieSameSite == 0 {
+		opts.CookieSameSite = http.SameSiteStrictMode
+	}
+	if opts.ImpersonationExpiry <= 0 {
+		opts.ImpersonationExpiry = defaultImpersonationExpiry
+	}
+	if opts.Guard == nil {
+		opts.Guard = appmiddleware.NewLoginGuard(s.Redis.Client, appmiddleware.LoginGuardConfig{
+			MaxAttempts: s.Cfg.Auth.RateLimit.LoginAttempts,
+			Window:      time.Duration(s.Cfg.Auth.RateLimit.WindowMinutes) * time.Minute,
+		})
+	}
+
+	h := &AuthHandlers{server: s, authn: authn, opts: opts}
+
+	g := s.Echo.Group(opts.Prefix)
+	g.POST("/login", h.Login)
+	g.POST("/refresh", h.Refresh)
+	g.POST("/logout", h.Logout)
+	g.GET("/me", h.Me, s.requireAccessToken...)
+	if opts.MFA != nil {
+		h.mountMFA(g)
+	}
+	if s.APIKeys != nil {
+		h.mountAPIKeys(g)
+	}
+	if opts.Impersonate != nil {
+		g.POST("/impersonate", h.Impersonate, h.requireAccessTokenAnd(opts.Impersonate)...)
+	}
+	if opts.Introspect != nil {
+		g.POST("/introspect", h.Introspect, h.requireAccessTokenAnd(opts.Introspect)...)
+	}
+
+	return h
+}
+
+// requireAccessTokenAnd authenticates the caller and then checks req
+func (h *AuthHandlers) requireAccessTokenAnd(req appmiddleware.Requirement) []echo.MiddlewareFunc {
+	chain := append([]echo.MiddlewareFunc{}, h.server.requireAccessToken...)
+	return append(chain, appmiddleware.RequireAll(req))
+}
+
+// Login exchanges a username and password for a token pair
+func (h *AuthHandlers) Login(c echo.Context) error {
+	var req loginRequest
+	if err := c.Bind(&req); err != nil || req.Username == "" || req.Password == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Username and password are required")
+	}
+
+	ctx := c.Request().Context()
+	ip := c.RealIP()
+	if err := h.opts.Guard.Check(ctx, req.Username, ip); err != nil {
+		return appmiddleware.LockoutResponse(c, err)
+	}
+
+	claims, err := h.authn.Authenticate(ctx, req.Username, req.Password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		if err := h.opts.Guard.RecordFailure(ctx, req.Username, ip); err != nil {
+			return appmiddleware.LockoutResponse(c, err)
+		}
+		return authError(c, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password")
+	}
+	if err != nil {
+		logger.Logger().Error("Authentication failed", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+
+	if err := h.opts.Guard.RecordSuccess(ctx, req.Username); err != nil {
+		logger.Logger().Error("Failed to reset login failures", logger.WithError(err))
+	}
+
+	claims.Base().DeviceID = req.DeviceID
+
+	challenge, err := h.challengeMFA(c, claims)
+	if err != nil {
+		logger.Logger().Error("Failed to start MFA challenge", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+	if challenge != nil {
+		return c.JSON(http.StatusOK, challenge)
+	}
+
+	pair, err := h.server.IssueTokenPair(claims)
+	if err != nil {
+		logger.Logger().Error("Failed to issue tokens", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+
+	return h.respondTokens(c, pair)
+}
+
+// Refresh exchanges a refresh token for a new token pair
+func (h *AuthHandlers) Refresh(c echo.Context) error {
+	var req refreshRequest
+	_ = c.Bind(&req)
+
+	token := h.refreshToken(c, req.RefreshToken)
+	if token == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Refresh token is required")
+	}
+
+	pair, err := h.server.RefreshTokens(c.Request().Context(), token, h.authn.LoadUser)
+	if err != nil {
+		h.clearCookies(c)
+		return authError(c, http.StatusUnauthorized, "invalid_token", "Refresh token is invalid or expired")
+	}
+
+	return h.respondTokens(c, pair)
+}
+
+// Logout ends the session of the presented refresh token, or every session
+// and access token of its user, and revokes the presented access token
+func (h *AuthHandlers) Logout(c echo.Context) error {
+	var req logoutRequest
+	_ = c.Bind(&req)
+
+	ctx := c.Request().Context()
+
+	if token := h.refreshToken(c, req.RefreshToken); token != "" {
+		if session, err := h.server.ValidateRefreshSession(ctx, token); err == nil {
+			if req.All {
+				err = h.server.RevokeRefreshToken(session.UserID)
+				if err == nil {
+					err = h.server.RevokeTokensIssuedBefore(ctx, session.UserID, time.Now())
+				}
+			} else {
+				err = h.server.RevokeSession(ctx, session.UserID, session.ID)
+			}
+			if err != nil {
+				logger.Logger().Error("Failed to revoke session", logger.WithError(err))
+				return authError(c, http.StatusInternalServerError, "internal_error", "Logout failed")
+			}
+		}
+	}
+
+	if token := h.accessToken(c); token != "" {
+		if parsed, err := h.server.parseAccessToken(token); err == nil {
+			claims := parsed.Claims.(Claims).Base()
+			if err := h.server.RevokeAccessToken(ctx, claims); err != nil {
+				logger.Logger().Error("Failed to revoke access token",
+					zap.Uint("user_id", claims.UserID),
+					logger.WithError(err),
+				)
+			}
+		}
+	}
+
+	h.clearCookies(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Me returns the claims of the authenticated caller
+func (h *AuthHandlers) Me(c echo.Context) error {
+	claims, ok := appmiddleware.CustomClaimsFromContext[Claims](c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	return c.JSON(http.StatusOK, claims)
+}
+
+// refreshToken prefers the token in the body over the cookie
+func (h *AuthHandlers) refreshToken(c echo.Context, fromBody string) string {
+	if fromBody != "" {
+		return fromBody
+	}
+	if cookie, err := c.Cookie(refreshTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// accessToken reads the bearer token from the header or cookie
+func (h *AuthHandlers) accessToken(c echo.Context) string {
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := c.Cookie(accessTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (h *AuthHandlers) respondTokens(c echo.Context, pair *TokenPair) error {
+	if !h.opts.Cookies {
+		return c.JSON(http.StatusOK, pair)
+	}
+
+	h.setTokenCookies(c, pair)
+
+	// Keep the tokens out of reach of scripts
+	return c.JSON(http.StatusOK, TokenPair{
+		TokenType: pair.TokenType,
+		ExpiresIn: pair.ExpiresIn,
+		DeviceID:  pair.DeviceID,
+	})
+}
+
+func (h *AuthHandlers) setTokenCookies(c echo.Context, pair *TokenPair) {
+	cfg := h.server.Cfg.JWT
+	h.setCookie(c, accessTokenCookie, pair.AccessToken, "/",
+		time.Duration(cfg.AccessExpiry)*time.Minute)
+	h.setCookie(c, refreshTokenCookie, pair.RefreshToken, h.opts.Prefix,
+		time.Duration(cfg.RefreshExpiry)*24*time.Hour)
+}
+
+func (h *AuthHandlers) clearCookies(c echo.Context) {
+	if !h.opts.Cookies {
+		return
+	}
+	h.setCookie(c, accessTokenCookie, "", "/", -1)
+	h.setCookie(c, refreshTokenCookie, "", h.opts.Prefix, -1)
+}
+
+// setCookie writes an HttpOnly token cookie; a negative maxAge deletes it
+func (h *AuthHandlers) setCookie(c echo.Context, name, value, path string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   h.opts.CookieDomain,
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   !h.opts.InsecureCookies,
+		SameSite: h.opts.CookieSameSite,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	c.SetCookie(cookie)
+}
+
+func authError(c echo.Context, status int, code, message string) error {
+	return c.JSON(status, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":    code,
+			"message": message,
+		}},
+		Message: message,
+	})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// defaultImpersonationExpiry keeps impersonation tokens short-lived; they
+// are never paired with a refresh token
+const defaultImpersonationExpiry = 15 * time.Minute
+
+// Actor identifies the admin behind an impersonation token
+type Actor = appmiddleware.Actor
+
+type impersonateRequest struct {
+	UserID uint   `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+type impersonateResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Act         *Actor `json:"act"`
+}
+
+// Impersonate signs an access token for target that carries actor in its
+// act claim. The token is an ordinary access token to every route; only
+// the request log, the audit trail and the endpoints that mint credentials
+// treat it differently.
+func (s *Server) Impersonate(actor *JWTClaims, target Claims, lifetime time.Duration) (string, error) {
+	if actor.Act != nil {
+		return "", fmt.Errorf("impersonation tokens cannot impersonate")
+	}
+	if actor.UserID == target.Base().UserID {
+		return "", fmt.Errorf("cannot impersonate yourself")
+	}
+
+	base := target.Base()
+	base.DeviceID = ""
+	base.Act = &Actor{
+		Subject:  actor.Subject,
+		UserID:   actor.UserID,
+		Username: actor.Username,
+	}
+	return s.signClaims(target, appmiddleware.TokenTypeAccess, lifetime)
+}
+
+// Impersonate issues the caller a short-lived access token acting as
+// another user. End it early by logging out with the token.
+func (h *AuthHandlers) Impersonate(c echo.Context) error {
+	actor, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	// Only people signed in interactively may impersonate, and only once
+	if actor.TokenType != appmiddleware.TokenTypeAccess || actor.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	var req impersonateRequest
+	if err := c.Bind(&req); err != nil || req.UserID == 0 || req.Reason == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "User ID and reason are required")
+	}
+	if req.UserID == actor.UserID {
+		return authError(c, http.StatusBadRequest, "invalid_request", "You cannot impersonate yourself")
+	}
+
+	target, err := h.authn.LoadUser(c.Request().Context(), req.UserID)
+	if err != nil {
+		return authError(c, http.StatusNotFound, "not_found", "User not found")
+	}
+	target.Base().UserID = req.UserID
+
+	// Admins cannot borrow each other's identities
+	if h.opts.Impersonate(target.Base(), h.server.policy) {
+		logger.SecurityEvent("impersonation_denied",
+			zap.Uint("actor_id", actor.UserID),
+			zap.Uint("user_id", req.UserID),
+			zap.String("ip", c.RealIP()),
+		)
+		return authError(c, http.StatusForbidden, "forbidden", "This user cannot be impersonated")
+	}
+
+	token, err := h.server.Impersonate(actor, target, h.opts.ImpersonationExpiry)
+	if err != nil {
+		logger.Logger().Error("Failed to issue impersonation token", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Impersonation failed")
+	}
+
+	base := target.Base()
+	logger.SecurityEvent("impersonation_started",
+		zap.Uint("actor_id", actor.UserID),
+		zap.String("actor_username", actor.Username),
+		zap.Uint("user_id", base.UserID),
+		zap.String("username", base.Username),
+		zap.String("reason", req.Reason),
+		zap.String("token_id", base.ID),
+		zap.String("ip", c.RealIP()),
+	)
+
+	return c.JSON(http.StatusOK, impersonateResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(h.opts.ImpersonationExpiry / time.Second),
+		Act:         base.Act,
+	})
+}
+
+// identifyCaller adds the caller to the request log. Requests made with an
+// impersonation token name both the user and the admin, and are written to
+// the audit trail.
+func (s *Server) identifyCaller(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, ok := appmiddleware.ClaimsFromContext(c)
+		if !ok {
+			return next(c)
+		}
+
+		logger.AddRequestFields(c, zap.Uint("user_id", claims.UserID))
+		if !claims.Impersonated() {
+			return next(c)
+		}
+		logger.AddRequestFields(c,
+			zap.Uint("actor_id", claims.Act.UserID),
+			zap.String("actor", claims.Act.Subject),
+		)
+
+		err := next(c)
+
+		logger.SecurityEvent("impersonated_request",
+			zap.Uint("user_id", claims.UserID),
+			zap.Uint("actor_id", claims.Act.UserID),
+			zap.String("actor_username", claims.Act.Username),
+			zap.String("token_id", claims.ID),
+			zap.String("method", c.Request().Method),
+			zap.String("path", c.Request().URL.Path),
+			zap.Int("status", c.Response().Status),
+			zap.String("ip", c.RealIP()),
+		)
+		return err
+	}
+}
+
+// isUserCaller reports whether claims belong to a user account rather than
+// a service identified by its client certificate
+func isUserCaller(claims *appmiddleware.JWTClaims) bool {
+	return claims.TokenType != appmiddleware.TokenTypeClientCert && claims.UserID != 0
+}
+
+// refuseNonUser answers requests that manage a user's own credentials from
+// a caller without a user account
+func refuseNonUser(c echo.Context) error {
+	return authError(c, http.StatusForbidden, "forbidden",
+		"This action requires a user account")
+}
+
+// refuseImpersonation answers requests an impersonation token may not
+// make, such as minting credentials that would outlive it
+func refuseImpersonation(c echo.Context) error {
+	return authError(c, http.StatusForbidden, "impersonation_forbidden",
+		"This action is not allowed while impersonating a user")
+}
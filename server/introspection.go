@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Token type hints accepted by the introspection endpoint
+const (
+	TokenTypeHintAccess  = "access_token"
+	TokenTypeHintRefresh = "refresh_token"
+)
+
+// TokenIntrospection describes a token as in RFC 7662. Inactive tokens,
+// whether expired, revoked, malformed or unknown, only report Active.
+type TokenIntrospection struct {
+	Active    bool             `json:"active"`
+	Scope     string           `json:"scope,omitempty"`
+	Username  string           `json:"username,omitempty"`
+	TokenType string           `json:"token_type,omitempty"`
+	ExpiresAt int64            `json:"exp,omitempty"`
+	IssuedAt  int64            `json:"iat,omitempty"`
+	NotBefore int64            `json:"nbf,omitempty"`
+	Subject   string           `json:"sub,omitempty"`
+	Audience  jwt.ClaimStrings `json:"aud,omitempty"`
+	Issuer    string           `json:"iss,omitempty"`
+	TokenID   string           `json:"jti,omitempty"`
+
+	// TokenUse is "access" or "refresh"
+	TokenUse  string `json:"token_use,omitempty"`
+	UserID    uint   `json:"user_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	// Act names the admin behind an impersonation token
+	Act *Actor `json:"act,omitempty"`
+}
+
+type introspectRequest struct {
+	Token         string `json:"token" form:"token"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+}
+
+func inactiveToken() *TokenIntrospection {
+	return &TokenIntrospection{Active: false}
+}
+
+// IntrospectToken reports whether an access or refresh token is currently
+// valid and what it grants. hint names the type to try first. An error is
+// only returned when validity cannot be determined.
+func (s *Server) IntrospectToken(ctx context.Context, token, hint string) (*TokenIntrospection, error) {
+	introspectors := []func(context.Context, string) (*TokenIntrospection, error){
+		s.introspectAccessToken,
+		s.introspectRefreshToken,
+	}
+	if hint == TokenTypeHintRefresh {
+		introspectors[0], introspectors[1] = introspectors[1], introspectors[0]
+	}
+
+	for _, introspect := range introspectors {
+		result, err := introspect(ctx, token)
+		if err != nil || result.Active {
+			return result, err
+		}
+	}
+	return inactiveToken(), nil
+}
+
+func (s *Server) introspectAccessToken(ctx context.Context, tokenString string) (*TokenIntrospection, error) {
+	token, err := s.parseAccessToken(tokenString)
+	if err != nil {
+		return inactiveToken(), nil
+	}
+	claims := token.Claims.(Claims).Base()
+
+	err = s.checkAccessToken(ctx, claims)
+	if errors.Is(err, ErrTokenRevoked) {
+		return inactiveToken(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := registeredIntrospection(claims.RegisteredClaims)
+	result.Scope = strings.Join(claims.Permissions, " ")
+	result.Username = claims.Username
+	result.TokenUse = appmiddleware.TokenTypeAccess
+	result.UserID = claims.UserID
+	result.Role = claims.Role
+	result.DeviceID = claims.DeviceID
+	result.Act = claims.Act
+	return result, nil
+}
+
+// introspectRefreshToken checks a refresh token like a refresh exchange
+// would, without consuming it or touching its session
+func (s *Server) introspectRefreshToken(ctx context.Context, tokenString string) (*TokenIntrospection, error) {
+	claims := &refreshClaims{}
+	if _, err := s.parseToken(tokenString, claims); err != nil {
+		return inactiveToken(), nil
+	}
+	if claims.TokenType != appmiddleware.TokenTypeRefresh || claims.UserID == 0 || claims.SessionID == "" {
+		return inactiveToken(), nil
+	}
+
+	session, err := s.loadSession(ctx, claims.UserID, claims.SessionID)
+	if err == redis.Nil {
+		return inactiveToken(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Rotated tokens are no longer valid
+	if session.tokenID != claims.ID {
+		return inactiveToken(), nil
+	}
+
+	validAfter, err := s.tokensValidAfter(ctx, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !validAfter.IsZero() && session.CreatedAt.Before(validAfter) {
+		return inactiveToken(), nil
+	}
+
+	result := registeredIntrospection(claims.RegisteredClaims)
+	result.TokenUse = appmiddleware.TokenTypeRefresh
+	result.UserID = claims.UserID
+	result.DeviceID = claims.DeviceID
+	result.SessionID = claims.SessionID
+	return result, nil
+}
+
+func registeredIntrospection(rc jwt.RegisteredClaims) *TokenIntrospection {
+	result := &TokenIntrospection{
+		Active:    true,
+		TokenType: "Bearer",
+		Subject:   rc.Subject,
+		Audience:  rc.Audience,
+		Issuer:    rc.Issuer,
+		TokenID:   rc.ID,
+	}
+	if rc.ExpiresAt != nil {
+		result.ExpiresAt = rc.ExpiresAt.Unix()
+	}
+	if rc.IssuedAt != nil {
+		result.IssuedAt = rc.IssuedAt.Unix()
+	}
+	if rc.NotBefore != nil {
+		result.NotBefore = rc.NotBefore.Unix()
+	}
+	return result
+}
+
+// Introspect reports what a token grants. It accepts the RFC 7662 form
+// parameters token and token_type_hint, or the same fields as JSON.
+func (h *AuthHandlers) Introspect(c echo.Context) error {
+	caller, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+
+	var req introspectRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Token is required")
+	}
+
+	result, err := h.server.IntrospectToken(c.Request().Context(), req.Token, req.TokenTypeHint)
+	if err != nil {
+		return serviceUnavailable(c, err)
+	}
+
+	logger.SecurityEvent("token_introspected",
+		zap.Uint("caller_id", caller.UserID),
+		zap.Bool("active", result.Active),
+		zap.Uint("user_id", result.UserID),
+		zap.String("token_id", result.TokenID),
+		zap.String("token_use", result.TokenUse),
+	)
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, result)
+}
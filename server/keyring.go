@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is a single key held by a KeyRing
+type SigningKey struct {
+	// ID is stamped into the token header as `kid`. The empty ID is
+	// reserved for the legacy HS256 secret so tokens issued without a
+	// `kid` keep verifying.
+	ID        string
+	Algorithm string
+	// Private is the signing key: []byte for HS256, *rsa.PrivateKey,
+	// *ecdsa.PrivateKey or ed25519.PrivateKey for asymmetric algorithms.
+	Private crypto.PrivateKey
+	// Public verifies tokens signed by Private. It is derived from Private
+	// when left nil.
+	Public crypto.PublicKey
+	// NotBefore is when the key becomes eligible for signing. Keys added
+	// with a future NotBefore are published in the JWKS ahead of use.
+	NotBefore time.Time
+	// RetireAt is when the key stops verifying. Zero means never.
+	RetireAt time.Time
+}
+
+// GenerateSigningKey creates a fresh asymmetric key with a random kid
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.PrivateKey
+	var err error
+
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", alg, err)
+	}
+
+	kid, err := randomKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: kid, Algorithm: alg, Private: private, NotBefore: time.Now()}
+	if err := key.init(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseSigningKeyPEM loads a PEM encoded private key for the given algorithm
+func ParseSigningKeyPEM(kid, alg string, data []byte) (*SigningKey, error) {
+	var private crypto.PrivateKey
+	var err error
+
+	switch alg {
+	case AlgRS256:
+		private, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case AlgES256:
+		private, err = jwt.ParseECPrivateKeyFromPEM(data)
+	case AlgEdDSA:
+		private, err = jwt.ParseEdPrivateKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s key %q: %w", alg, kid, err)
+	}
+
+	key := &SigningKey{ID: kid, Algorithm: alg, Private: private}
+	if err := key.init(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// init derives the public key and checks the key material matches the algorithm
+func (k *SigningKey) init() error {
+	switch k.Algorithm {
+	case AlgHS256:
+		secret, ok := k.Private.([]byte)
+		if !ok || len(secret) == 0 {
+			return fmt.Errorf("key %q: HS256 requires a non-empty []byte secret", k.ID)
+		}
+		k.Public = secret
+	case AlgRS256:
+		private, ok := k.Private.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("key %q: RS256 requires an RSA private key", k.ID)
+		}
+		k.Public = &private.PublicKey
+	case AlgES256:
+		private, ok := k.Private.(*ecdsa.PrivateKey)
+		if !ok || private.Curve != elliptic.P256() {
+			return fmt.Errorf("key %q: ES256 requires a P-256 private key", k.ID)
+		}
+		k.Public = &private.PublicKey
+	case AlgEdDSA:
+		private, ok := k.Private.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("key %q: EdDSA requires an Ed25519 private key", k.ID)
+		}
+		k.Public = private.Public()
+	default:
+		return fmt.Errorf("key %q: unsupported signing algorithm: %s", k.ID, k.Algorithm)
+	}
+	return nil
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// KeyRing holds the keys used to sign and verify tokens. Exactly one key
+// is active for signing at a time; every key that has not been retired is
+// accepted for verification.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []*SigningKey
+}
+
+// NewKeyRing creates a key ring from the given keys
+func NewKeyRing(keys ...*SigningKey) (*KeyRing, error) {
+	kr := &KeyRing{}
+	for _, key := range keys {
+		if err := kr.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// newSecretKeyRing wraps the configured shared secret as the legacy HS256 key
+func newSecretKeyRing(secret string) (*KeyRing, error) {
+	return NewKeyRing(&SigningKey{Algorithm: AlgHS256, Private: []byte(secret)})
+}
+
+// Add inserts a key into the ring. Keys with a future NotBefore are
+// published for verification but not used for signing until then.
+func (r *KeyRing) Add(key *SigningKey) error {
+	if key == nil {
+		return fmt.Errorf("signing key is nil")
+	}
+	if err := key.init(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.keys {
+		if existing.ID == key.ID {
+			return fmt.Errorf("duplicate signing key id %q", key.ID)
+		}
+	}
+	r.keys = append(r.keys, key)
+	sort.SliceStable(r.keys, func(i, j int) bool {
+		return r.keys[i].NotBefore.Before(r.keys[j].NotBefore)
+	})
+	return nil
+}
+
+// Rotate makes next the signing key once its NotBefore is reached (now if
+// unset). Keys that were previously in the ring keep verifying for the
+// overlap window after that point and are then dropped.
+func (r *KeyRing) Rotate(next *SigningKey, overlap time.Duration) error {
+	now := time.Now()
+	if next != nil && next.NotBefore.IsZero() {
+		next.NotBefore = now
+	}
+	if err := r.Add(next); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	retireAt := next.NotBefore.Add(overlap)
+	kept := r.keys[:0]
+	for _, key := range r.keys {
+		if key != next && (key.RetireAt.IsZero() || key.RetireAt.After(retireAt)) {
+			key.RetireAt = retireAt
+		}
+		if !key.retired(now) {
+			kept = append(kept, key)
+		}
+	}
+	r.keys = kept
+	return nil
+}
+
+// StartRotation rotates in a key from next every interval until ctx is
+// done. When several replicas share one issuer, next should load keys from
+// shared storage rather than generating them locally.
+func (r *KeyRing) StartRotation(ctx context.Context, interval, overlap time.Duration, next func() (*SigningKey, error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				key, err := next()
+				if err == nil {
+					err = r.Rotate(key, overlap)
+				}
+				if err != nil {
+					logger.Logger().Error("Signing key rotation failed", logger.WithError(err))
+					continue
+				}
+				logger.Logger().Info("Signing key rotated",
+					zap.String("kid", key.ID),
+					zap.String("alg", key.Algorithm),
+					zap.Time("previous_keys_retire_at", key.NotBefore.Add(overlap)),
+				)
+			}
+		}
+	}()
+}
+
+// Active returns the key currently used for signing
+func (r *KeyRing) Active() (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		key := r.keys[i]
+		if !key.NotBefore.After(now) && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no active signing key")
+}
+
+// Lookup returns the verification key for kid if it has not been retired
+func (r *KeyRing) Lookup(kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range r.keys {
+		if key.ID == kid && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key id %q", kid)
+}
+
+// Keys returns a snapshot of the keys that still verify
+func (r *KeyRing) Keys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		if !key.retired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Sign signs claims with the active key and stamps its kid in the header
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key, err := r.Active()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc selects the verification key by the token's kid and rejects
+// tokens whose algorithm does not match the key's
+func (r *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := r.Lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+func randomKeyID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate key id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
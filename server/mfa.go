@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/1827mk/app-server/mfa"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// ErrMFARequired is returned when an MFA pending token is presented where
+// an access token is required
+var ErrMFARequired = errors.New("mfa verification required")
+
+// mfaPendingExpiry is how long a user has to enter the second factor
+const mfaPendingExpiry = 5 * time.Minute
+
+// mfaChallenge is returned by login instead of tokens when MFA is enabled
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type mfaVerifyRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func mfaPendingUsedKey(tokenID string) string {
+	return fmt.Sprintf("mfa_pending_used:%s", tokenID)
+}
+
+// IssueMFAPendingToken signs a short-lived token that proves the first
+// factor. It is rejected on /api routes and can only be exchanged for a
+// token pair at the MFA verification endpoint.
+func (s *Server) IssueMFAPendingToken(claims Claims) (string, error) {
+	return s.signClaims(claims, appmiddleware.TokenTypeMFAPending, mfaPendingExpiry)
+}
+
+// parseMFAPendingToken verifies an MFA pending token into the registered
+// claims type
+func (s *Server) parseMFAPendingToken(tokenString string) (Claims, error) {
+	claims := s.newClaims()
+	if _, err := s.parseToken(tokenString, claims); err != nil {
+		return nil, fmt.Errorf("invalid mfa token: %w", err)
+	}
+	if claims.Base().TokenType != appmiddleware.TokenTypeMFAPending {
+		return nil, fmt.Errorf("invalid token type")
+	}
+	return claims, nil
+}
+
+// consumeMFAPendingToken makes sure a pending token completes MFA only once
+func (s *Server) consumeMFAPendingToken(ctx context.Context, claims *JWTClaims) error {
+	ok, err := s.Redis.Client.SetNX(ctx, mfaPendingUsedKey(claims.ID), 1, mfaPendingExpiry).Result()
+	if err != nil {
+		return fmt.Errorf("failed to consume mfa token: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("mfa token has already been used")
+	}
+	return nil
+}
+
+// mountMFA registers the MFA endpoints under the auth prefix
+func (h *AuthHandlers) mountMFA(g *echo.Group) {
+	requireAccessToken := h.server.requireAccessToken
+	g.POST("/mfa/verify", h.VerifyMFA)
+	g.POST("/mfa/enroll", h.EnrollMFA, requireAccessToken...)
+	g.POST("/mfa/confirm", h.ConfirmMFA, requireAccessToken...)
+	g.POST("/mfa/disable", h.DisableMFA, requireAccessToken...)
+}
+
+// challengeMFA answers a successful password check of a user with MFA
+// enabled, or returns nil if the user can be issued tokens directly
+func (h *AuthHandlers) challengeMFA(c echo.Context, claims Claims) (*mfaChallenge, error) {
+	if h.opts.MFA == nil {
+		return nil, nil
+	}
+
+	enabled, err := h.opts.MFA.Enabled(c.Request().Context(), claims.Base().UserID)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	token, err := h.server.IssueMFAPendingToken(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &mfaChallenge{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(mfaPendingExpiry / time.Second),
+	}, nil
+}
+
+// VerifyMFA exchanges an MFA pending token and a TOTP or recovery code for
+// a token pair
+func (h *AuthHandlers) VerifyMFA(c echo.Context) error {
+	var req mfaVerifyRequest
+	if err := c.Bind(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "MFA token and code are required")
+	}
+
+	claims, err := h.server.parseMFAPendingToken(req.MFAToken)
+	if err != nil {
+		return authError(c, http.StatusUnauthorized, "invalid_token", "MFA token is invalid or expired")
+	}
+	base := claims.Base()
+
+	ctx := c.Request().Context()
+	ip := c.RealIP()
+	if err := h.opts.Guard.Check(ctx, base.Username, ip); err != nil {
+		return appmiddleware.LockoutResponse(c, err)
+	}
+
+	err = h.opts.MFA.Verify(ctx, base.UserID, req.Code)
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		if err := h.opts.Guard.RecordFailure(ctx, base.Username, ip); err != nil {
+			return appmiddleware.LockoutResponse(c, err)
+		}
+		return authError(c, http.StatusUnauthorized, "invalid_code", "Invalid verification code")
+	}
+	if err != nil {
+		logger.Logger().Error("MFA verification failed",
+			zap.Uint("user_id", base.UserID),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusInternalServerError, "internal_error", "Verification failed")
+	}
+
+	if err := h.server.consumeMFAPendingToken(ctx, base); err != nil {
+		return authError(c, http.StatusUnauthorized, "invalid_token", "MFA token is invalid or expired")
+	}
+
+	if err := h.opts.Guard.RecordSuccess(ctx, base.Username); err != nil {
+		logger.Logger().Error("Failed to reset login failures", logger.WithError(err))
+	}
+
+	pair, err := h.server.IssueTokenPair(claims)
+	if err != nil {
+		logger.Logger().Error("Failed to issue tokens", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+
+	return h.respondTokens(c, pair)
+}
+
+// EnrollMFA starts TOTP enrollment for the caller and returns the secret
+// and provisioning URI
+func (h *AuthHandlers) EnrollMFA(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	account := claims.Email
+	if account == "" {
+		account = claims.Username
+	}
+
+	enrollment, err := h.opts.MFA.Enroll(c.Request().Context(), claims.UserID, account)
+	if err != nil {
+		logger.Logger().Error("MFA enrollment failed",
+			zap.Uint("user_id", claims.UserID),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusConflict, "mfa_enroll_failed", "MFA enrollment failed")
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmMFA enables MFA with the first code from the authenticator app and
+// returns the recovery codes
+func (h *AuthHandlers) ConfirmMFA(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	var req mfaCodeRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Code is required")
+	}
+
+	codes, err := h.opts.MFA.Confirm(c.Request().Context(), claims.UserID, req.Code)
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		return authError(c, http.StatusUnauthorized, "invalid_code", "Invalid verification code")
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		return authError(c, http.StatusConflict, "mfa_not_enrolled", "MFA enrollment has not been started")
+	case err != nil:
+		logger.Logger().Error("MFA confirmation failed",
+			zap.Uint("user_id", claims.UserID),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusInternalServerError, "internal_error", "MFA confirmation failed")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns MFA off after checking a current code. Wrong codes count
+// towards the login lockout like those of the MFA login step, so a stolen
+// access token cannot guess its way past the second factor.
+func (h *AuthHandlers) DisableMFA(c echo.Context) error {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return authError(c, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	if !isUserCaller(claims) {
+		return refuseNonUser(c)
+	}
+	if claims.Impersonated() {
+		return refuseImpersonation(c)
+	}
+
+	var req mfaCodeRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return authError(c, http.StatusBadRequest, "invalid_request", "Code is required")
+	}
+
+	ctx := c.Request().Context()
+	ip := c.RealIP()
+	if err := h.opts.Guard.Check(ctx, claims.Username, ip); err != nil {
+		return appmiddleware.LockoutResponse(c, err)
+	}
+
+	err := h.opts.MFA.Verify(ctx, claims.UserID, req.Code)
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		if err := h.opts.Guard.RecordFailure(ctx, claims.Username, ip); err != nil {
+			return appmiddleware.LockoutResponse(c, err)
+		}
+		return authError(c, http.StatusUnauthorized, "invalid_code", "Invalid verification code")
+	}
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		return authError(c, http.StatusUnauthorized, "invalid_code", "Invalid verification code")
+	}
+	if err == nil {
+		if err := h.opts.Guard.RecordSuccess(ctx, claims.Username); err != nil {
+			logger.Logger().Error("Failed to reset login failures", logger.WithError(err))
+		}
+		err = h.opts.MFA.Disable(ctx, claims.UserID)
+	}
+	if err != nil {
+		logger.Logger().Error("Failed to disable MFA",
+			zap.Uint("user_id", claims.UserID),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusInternalServerError, "internal_error", "Failed to disable MFA")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
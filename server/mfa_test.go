@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+func TestDisableMFAIsThrottledByLoginGuard(t *testing.T) {
+	s := newTestServer(t)
+	guard := appmiddleware.NewLoginGuard(s.Redis.Client, appmiddleware.LoginGuardConfig{MaxAttempts: 1})
+	// The MFA manager is never reached while the account is locked
+	h := s.MountAuth(testAuthenticator{}, AuthOptions{Guard: guard})
+
+	if err := guard.RecordFailure(context.Background(), "alice", "192.0.2.1"); err == nil {
+		t.Fatal("account not locked")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/mfa/disable", strings.NewReader(`{"code":"123456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := s.Echo.NewContext(req, rec)
+	c.Set(appmiddleware.ClaimsContextKey, &JWTClaims{UserID: 1, Username: "alice"})
+
+	if err := h.DisableMFA(c); err != nil {
+		t.Fatalf("DisableMFA: %v", err)
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	"github.com/1827mk/app-server/oidc"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// oidcStateCookie binds a started provider login to the browser
+const oidcStateCookie = "oidc_state"
+
+// IdentityResolver maps an identity verified by an OpenID Connect provider
+// to the claims of a local user, creating the user if the application
+// allows it. Returning an error refuses the login.
+type IdentityResolver func(ctx context.Context, identity *oidc.Identity) (Claims, error)
+
+// oidcHandlers serves the login and callback endpoints of one provider
+type oidcHandlers struct {
+	auth    *AuthHandlers
+	name    string
+	rp      *oidc.RelyingParty
+	resolve IdentityResolver
+}
+
+// MountOIDC registers GET {prefix}/oidc/{name}/login and
+// GET {prefix}/oidc/{name}/callback for a provider. The relying party's
+// redirect URL must point at the callback. A successful login is answered
+// like a password login, with a token pair or token cookies, or with an MFA
+// challenge for users who enabled a second factor. In cookie mode the
+// challenge is passed to the return_to page in the URL fragment.
+func (h *AuthHandlers) MountOIDC(name string, rp *oidc.RelyingParty, resolve IdentityResolver) {
+	o := &oidcHandlers{auth: h, name: name, rp: rp, resolve: resolve}
+
+	g := h.server.Echo.Group(h.opts.Prefix + "/oidc/" + name)
+	g.GET("/login", o.Login)
+	g.GET("/callback", o.Callback)
+}
+
+// Login redirects to the provider. An optional return_to query parameter
+// names the local page to return to once cookies are set.
+func (o *oidcHandlers) Login(c echo.Context) error {
+	returnTo := c.QueryParam("return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = "/"
+	}
+
+	authURL, state, err := o.rp.AuthCodeURL(c.Request().Context(), returnTo)
+	if err != nil {
+		logger.Logger().Error("Failed to start OIDC login",
+			zap.String("provider", o.name),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusInternalServerError, "internal_error", "Login failed")
+	}
+
+	o.setStateCookie(c, state, int(o.rp.StateTTL()/time.Second))
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// setStateCookie remembers the state of the login this browser started. It
+// is Lax rather than Strict so that it survives the redirect back from the
+// provider; a negative maxAge deletes it.
+func (o *oidcHandlers) setStateCookie(c echo.Context, state string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     o.auth.opts.Prefix + "/oidc/" + o.name,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !o.auth.opts.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Callback completes the provider login and issues our own tokens
+func (o *oidcHandlers) Callback(c echo.Context) error {
+	if providerErr := c.QueryParam("error"); providerErr != "" {
+		return authError(c, http.StatusUnauthorized, "oidc_"+providerErr,
+			"The identity provider refused the login")
+	}
+
+	var boundState string
+	if cookie, err := c.Cookie(oidcStateCookie); err == nil {
+		boundState = cookie.Value
+	}
+	o.setStateCookie(c, "", -1)
+
+	ctx := c.Request().Context()
+	identity, returnTo, err := o.rp.Exchange(ctx, c.QueryParam("state"), c.QueryParam("code"), boundState)
+	switch {
+	case errors.Is(err, oidc.ErrStateMismatch):
+		logger.SecurityEvent("oidc_state_mismatch",
+			zap.String("provider", o.name),
+			zap.String("ip", c.RealIP()),
+		)
+		return authError(c, http.StatusBadRequest, "invalid_state", "Login session is invalid or expired")
+	case errors.Is(err, oidc.ErrInvalidState):
+		return authError(c, http.StatusBadRequest, "invalid_state", "Login session is invalid or expired")
+	case errors.Is(err, oidc.ErrInvalidIDToken):
+		logger.SecurityEvent("oidc_id_token_rejected",
+			zap.String("provider", o.name),
+			zap.String("ip", c.RealIP()),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusUnauthorized, "invalid_token", "The identity provider's token is invalid")
+	case err != nil:
+		logger.Logger().Error("OIDC code exchange failed",
+			zap.String("provider", o.name),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusBadGateway, "oidc_unavailable", "The identity provider could not be reached")
+	}
+
+	claims, err := o.resolve(ctx, identity)
+	if err != nil {
+		logger.SecurityEvent("oidc_login_refused",
+			zap.String("provider", o.name),
+			zap.String("subject", identity.Subject),
+			zap.String("email", identity.Email),
+			logger.WithError(err),
+		)
+		return authError(c, http.StatusForbidden, "forbidden", "This account may not sign in")
+	}
+
+	// A provider login stands in for the password, not the second factor
+	challenge, err := o.auth.challengeMFA(c, claims)
+	if err != nil {
+		logger.Logger().Error("Failed to start MFA challenge", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+	if challenge != nil {
+		if o.auth.opts.Cookies {
+			// The fragment stays in the browser, where the application
+			// picks up the token to complete the login at /mfa/verify
+			fragment := url.Values{
+				"mfa_required": {"true"},
+				"mfa_token":    {challenge.MFAToken},
+				"expires_in":   {strconv.FormatInt(challenge.ExpiresIn, 10)},
+			}
+			page, _, _ := strings.Cut(returnTo, "#")
+			return c.Redirect(http.StatusFound, page+"#"+fragment.Encode())
+		}
+		return c.JSON(http.StatusOK, challenge)
+	}
+
+	pair, err := o.auth.server.IssueTokenPair(claims)
+	if err != nil {
+		logger.Logger().Error("Failed to issue tokens", logger.WithError(err))
+		return authError(c, http.StatusInternalServerError, "internal_error", "Authentication failed")
+	}
+
+	// Browsers land back on the application with the cookies set
+	if o.auth.opts.Cookies {
+		o.auth.setTokenCookies(c, pair)
+		return c.Redirect(http.StatusFound, returnTo)
+	}
+	return c.JSON(http.StatusOK, pair)
+}
+
+// isLocalPath accepts only same-origin paths, so return_to cannot be used
+// as an open redirect. Browsers drop tabs and newlines from URLs and read
+// backslashes as slashes, so /\t/evil.example would lead off-site; paths
+// containing them are refused outright.
+func isLocalPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return false
+	}
+	for _, r := range path {
+		if r < 0x20 || r == 0x7f || r == '\\' {
+			return false
+		}
+	}
+	u, err := url.Parse(path)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.Opaque == ""
+}
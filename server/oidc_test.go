@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/1827mk/app-commons/conf"
+	"github.com/1827mk/app-server/datastore"
+	"github.com/1827mk/app-server/oidc"
+	"github.com/1827mk/app-server/oidc/oidctest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestServer builds a server on an in-memory Redis, without Postgres
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	cfg := &conf.Config{}
+	cfg.JWT.Secret = "test-secret"
+	cfg.JWT.Issuer = "test-issuer"
+	cfg.JWT.Audience = "test-audience"
+	cfg.JWT.AccessExpiry = 5
+	cfg.JWT.RefreshExpiry = 1
+
+	keys, err := newSecretKeyRing(cfg.JWT.Secret)
+	if err != nil {
+		t.Fatalf("newSecretKeyRing: %v", err)
+	}
+	s := &Server{
+		Echo:       echo.New(),
+		Cfg:        cfg,
+		Keys:       keys,
+		Redis:      &datastore.RedisClient{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+		newClaims:  func() Claims { return new(JWTClaims) },
+		validation: TokenValidation{Issuer: cfg.JWT.Issuer, Audience: cfg.JWT.Audience},
+	}
+	s.ready.Store(true)
+	s.configureJWTMiddleware()
+	return s
+}
+
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(ctx context.Context, username, password string) (Claims, error) {
+	return nil, ErrInvalidCredentials
+}
+
+func (testAuthenticator) LoadUser(ctx context.Context, userID uint) (Claims, error) {
+	return &JWTClaims{UserID: userID}, nil
+}
+
+type oidcTest struct {
+	server   *Server
+	provider *oidctest.Provider
+}
+
+func newOIDCTest(t *testing.T, opts AuthOptions) *oidcTest {
+	t.Helper()
+
+	s := newTestServer(t)
+	provider := oidctest.NewProvider("client", "")
+	t.Cleanup(provider.Close)
+
+	rp, err := oidc.NewRelyingParty(context.Background(), oidc.Config{
+		Issuer:      provider.Issuer(),
+		ClientID:    "client",
+		RedirectURL: "http://app.test/auth/oidc/test/callback",
+	}, s.Redis.Client, provider.Client())
+	if err != nil {
+		t.Fatalf("NewRelyingParty: %v", err)
+	}
+
+	h := s.MountAuth(testAuthenticator{}, opts)
+	h.MountOIDC("test", rp, func(ctx context.Context, identity *oidc.Identity) (Claims, error) {
+		return &JWTClaims{UserID: 42, Username: identity.Subject, Email: identity.Email}, nil
+	})
+	return &oidcTest{server: s, provider: provider}
+}
+
+func (o *oidcTest) serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	o.server.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+// login starts a login and returns the state cookie and the callback URL
+// the provider redirects the browser to
+func (o *oidcTest) login(t *testing.T, returnTo string) (*http.Cookie, string) {
+	t.Helper()
+
+	rec := o.serve(httptest.NewRequest(http.MethodGet,
+		"/auth/oidc/test/login?return_to="+url.QueryEscape(returnTo), nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d", rec.Code)
+	}
+
+	var stateCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil || !stateCookie.HttpOnly || stateCookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("login: state cookie = %+v", stateCookie)
+	}
+
+	client := o.provider.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	return stateCookie, callback.RequestURI()
+}
+
+func TestOIDCCallbackIssuesTokens(t *testing.T) {
+	o := newOIDCTest(t, AuthOptions{})
+	o.provider.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.com"})
+
+	cookie, callback := o.login(t, "/app")
+	req := httptest.NewRequest(http.MethodGet, callback, nil)
+	req.AddCookie(cookie)
+	rec := o.serve(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var pair TokenPair
+	if err := json.Unmarshal(rec.Body.Bytes(), &pair); err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	token, err := o.server.parseAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	claims := token.Claims.(Claims).Base()
+	if claims.UserID != 42 || claims.Username != "alice" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if pair.RefreshToken == "" {
+		t.Error("no refresh token")
+	}
+}
+
+func TestOIDCCallbackSetsCookies(t *testing.T) {
+	o := newOIDCTest(t, AuthOptions{Cookies: true})
+
+	cookie, callback := o.login(t, "/app")
+	req := httptest.NewRequest(http.MethodGet, callback, nil)
+	req.AddCookie(cookie)
+	rec := o.serve(req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/app" {
+		t.Fatalf("callback: status %d, location %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	names := map[string]bool{}
+	for _, cookie := range rec.Result().Cookies() {
+		names[cookie.Name] = cookie.MaxAge >= 0
+	}
+	if !names[accessTokenCookie] || !names[refreshTokenCookie] {
+		t.Errorf("token cookies not set: %v", names)
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	o := newOIDCTest(t, AuthOptions{Cookies: true})
+
+	// A callback URL from a login started in another browser
+	_, callback := o.login(t, "/app")
+
+	for name, cookie := range map[string]*http.Cookie{
+		"missing": nil,
+		"other":   {Name: oidcStateCookie, Value: "another-login"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, callback, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := o.serve(req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_state") {
+			t.Errorf("%s state cookie: status %d: %s", name, rec.Code, rec.Body)
+		}
+		for _, set := range rec.Result().Cookies() {
+			if set.Name == accessTokenCookie && set.MaxAge >= 0 {
+				t.Errorf("%s state cookie: access token cookie set", name)
+			}
+		}
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/":                    true,
+		"/app":                 true,
+		"/app?tab=keys#top":    true,
+		"":                     false,
+		"app":                  false,
+		"https://evil.example": false,
+		"//evil.example":       false,
+		"/\\evil.example":      false,
+		"/app\\..\\evil":       false,
+		"/\t/evil.example":     false,
+		"/\n/evil.example":     false,
+		"/\r/evil.example":     false,
+		"/\x00/evil.example":   false,
+		"/\x7f/evil.example":   false,
+	} {
+		if got := isLocalPath(path); got != want {
+			t.Errorf("isLocalPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestOIDCLoginIgnoresForeignReturnTo(t *testing.T) {
+	o := newOIDCTest(t, AuthOptions{Cookies: true})
+
+	cookie, callback := o.login(t, "/\t/evil.example")
+	req := httptest.NewRequest(http.MethodGet, callback, nil)
+	req.AddCookie(cookie)
+	rec := o.serve(req)
+	if location := rec.Header().Get("Location"); rec.Code != http.StatusFound || location != "/" {
+		t.Errorf("callback: status %d, location %q; want /", rec.Code, location)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/1827mk/app-server/apikey"
+	"github.com/1827mk/app-server/datastore"
+	"github.com/1827mk/app-server/middleware"
+	"github.com/1827mk/app-server/quota"
+)
+
+// Option customises a Server created by NewServer
+type Option func(*Server)
+
+// WithKeyRing signs and verifies tokens with kr instead of the HS256
+// secret from the JWT configuration
+func WithKeyRing(kr *KeyRing) Option {
+	return func(s *Server) {
+		s.Keys = kr
+	}
+}
+
+// WithPolicy resolves role hierarchies and permissions for the
+// middleware.RequireRole and middleware.RequirePermission checks
+func WithPolicy(p *middleware.Policy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// WithClaims registers the application's claims type. newClaims must return
+// a fresh pointer to a struct embedding JWTClaims; it is used to parse every
+// access token, and handlers read it back with
+// middleware.CustomClaimsFromContext.
+func WithClaims(newClaims func() middleware.Claims) Option {
+	return func(s *Server) {
+		s.newClaims = newClaims
+	}
+}
+
+// WithTokenValidation overrides how tokens are verified. Empty issuer and
+// audience fall back to the JWT configuration.
+func WithTokenValidation(v TokenValidation) Option {
+	return func(s *Server) {
+		s.validation = v
+	}
+}
+
+// WithAPIKeys lets /api routes authenticate with an X-API-Key header as an
+// alternative to a bearer token, using keys stored in the server's
+// database. load supplies the claims of the key's owner; when nil the
+// claims carry only the user ID. Either way the key's scopes replace the
+// owner's role and permissions.
+func WithAPIKeys(cfg apikey.Config, load SubjectLoader) Option {
+	return func(s *Server) {
+		s.apiKeyConfig = &cfg
+		s.loadKeyOwner = load
+	}
+}
+
+// WithTLS makes Start serve HTTPS with the given certificate files, which
+// are reloaded when they change
+func WithTLS(cfg TLSConfig) Option {
+	return func(s *Server) {
+		s.tlsConfig = &cfg
+	}
+}
+
+// WithClientCertAuth lets /api routes authenticate callers by a client
+// certificate the TLS handshake verified, as an alternative to a bearer
+// token or API key. Requests that also carry a token are authenticated by
+// the token. Certificates identify services rather than users, so the /auth
+// endpoints do not accept them. Requires WithTLS with a client CA file.
+func WithClientCertAuth(cfg middleware.ClientCertConfig) Option {
+	return func(s *Server) {
+		s.clientCerts = &cfg
+	}
+}
+
+// WithRateLimits enforces p on /api routes, counting requests in Redis.
+// Keep p to change the rules at runtime with its Update or Reload methods.
+func WithRateLimits(p *middleware.RateLimitPolicy) Option {
+	return func(s *Server) {
+		s.rateLimits = p
+	}
+}
+
+// WithQuotas meters /api requests per user per day and month and enforces
+// the quotas of the caller's plan. Usage is flushed to the quota_usage
+// table created by quota.Schema.
+func WithQuotas(cfg quota.Config) Option {
+	return func(s *Server) {
+		s.quotaConfig = &cfg
+	}
+}
+
+// WithMigrations applies the numbered migrations in fsys when the server
+// starts, refusing to start if an applied migration has changed. Use
+// fs.Sub to point into an embed.FS or os.DirFS for a directory.
+func WithMigrations(fsys fs.FS) Option {
+	return func(s *Server) {
+		s.migrations = fsys
+	}
+}
+
+// WithMigrationLockTimeout bounds how long a starting replica waits for
+// another one that is running the migrations. Defaults to five minutes.
+func WithMigrationLockTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.migrationLockTimeout = d
+	}
+}
+
+// WithDatabase adjusts the database settings read from the configuration,
+// for those it cannot carry such as pool limits, TLS files or a full DSN:
+//
+//	server.WithDatabase(func(db *datastore.DBConfig) {
+//		db.SSLMode = "verify-full"
+//		db.MaxOpenConns = 20
+//	})
+func WithDatabase(configure func(db *datastore.DBConfig)) Option {
+	return func(s *Server) {
+		s.configureDB = append(s.configureDB, configure)
+	}
+}
+
+// WithStartupRetry waits for the database and Redis to come up, retrying
+// with exponential backoff until retry.Timeout, instead of failing on the
+// first refused connection
+func WithStartupRetry(retry datastore.RetryConfig) Option {
+	return func(s *Server) {
+		s.startupRetry = retry
+	}
+}
+
+// WithDegradedStart lets NewServer return before the database and Redis
+// are reachable. They are connected, and migrations run, in the
+// background; until then Readiness reports 503. Only unreachable
+// dependencies are waited for: if the migrations fail, for example because
+// an applied one was modified, the server shuts down and Start returns the
+// error.
+func WithDegradedStart() Option {
+	return func(s *Server) {
+		s.degradedStart = true
+	}
+}
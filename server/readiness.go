@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/1827mk/app-server/datastore"
+	"github.com/1827mk/app-server/logger"
+	"github.com/labstack/echo/v4"
+)
+
+// Ready reports whether the database and Redis are connected. It only
+// turns false before the first connection of a degraded start.
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+// Readiness answers readiness probes with 200 once the server is ready and
+// 503 before:
+//
+//	s.Echo.GET("/readyz", s.Readiness)
+func (s *Server) Readiness(c echo.Context) error {
+	if !s.Ready() {
+		return serviceUnavailable(c, fmt.Errorf("waiting for the database and redis"))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "ready",
+	})
+}
+
+// connect brings up the dependencies of a degraded start. Each round waits
+// as long as the startup retry allows and failed rounds are repeated until
+// the server stops. A database that is reachable but cannot be brought up,
+// for example because an applied migration was modified, is not retried:
+// the server shuts down and Start returns the error.
+func (s *Server) connect(ctx context.Context, dbConfig *datastore.DBConfig, redisConfig *datastore.RedisConfig) {
+	pause := s.startupRetry.MaxInterval
+	if pause <= 0 {
+		pause = 10 * time.Second
+	}
+
+	steps := []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			err := s.Database.Connect(ctx, dbConfig)
+			if err != nil && !errors.Is(err, datastore.ErrUnreachable) {
+				return permanentError{err}
+			}
+			return err
+		},
+		// Connecting to Redis only pings, so every failure is worth a retry
+		func(ctx context.Context) error { return s.Redis.Connect(ctx, redisConfig) },
+	}
+	for _, step := range steps {
+		for {
+			err := step(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if isPermanent(err) {
+				s.fail(err)
+				return
+			}
+			logger.Logger().Error("Server is not ready", logger.WithError(err))
+
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	s.ready.Store(true)
+	logger.Logger().Info("Server is ready")
+}
+
+// permanentError marks a startup failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func isPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// fail stops a degraded start that cannot complete. Start returns err.
+func (s *Server) fail(err error) {
+	logger.Logger().Error("Server cannot start", logger.WithError(err))
+	s.startupErr.Store(&err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Echo.Shutdown(ctx); err != nil {
+		logger.Logger().Error("Failed to shut down", logger.WithError(err))
+	}
+}
+
+// startupFailure returns the error that stopped a degraded start, if any
+func (s *Server) startupFailure() error {
+	if err := s.startupErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1827mk/app-server/datastore"
+)
+
+func TestStartReturnsPermanentStartupFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.ready.Store(false)
+
+	failure := permanentError{datastore.ErrChecksumMismatch}
+	if !isPermanent(failure) {
+		t.Fatal("permanentError is not permanent")
+	}
+	s.fail(failure)
+
+	if err := s.Start(); !errors.Is(err, datastore.ErrChecksumMismatch) {
+		t.Errorf("Start = %v, want the startup failure", err)
+	}
+	if s.Ready() {
+		t.Error("failed server reports ready")
+	}
+}
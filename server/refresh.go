@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// exchanged is presented again. The whole token family has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// TokenPair is the result of a login or a refresh token exchange
+type TokenPair struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	// DeviceID names the session's device. Clients that did not send one
+	// at login should send this one at their next login.
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// SubjectLoader looks up the current claims of a user when a refresh token
+// is exchanged, so role changes and disabled accounts take effect without
+// waiting for the session to expire
+type SubjectLoader func(ctx context.Context, userID uint) (Claims, error)
+
+// refreshClaims are the claims of a refresh token
+type refreshClaims struct {
+	UserID    uint   `json:"user_id"`
+	DeviceID  string `json:"device_id"`
+	SessionID string `json:"sid"`
+	TokenType string `json:"token_type"`
+	jwt.RegisteredClaims
+}
+
+// parsedRefreshToken holds the claims of a parsed refresh token
+type parsedRefreshToken struct {
+	UserID    uint
+	SessionID string
+	TokenID   string
+}
+
+// rotateRefreshScript swaps the family's current jti for the next one only
+// if the presented jti is still current.
+// Returns 1 when rotated, 0 when the family is gone and -1 on reuse.
+var rotateRefreshScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'jti')
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'jti', ARGV[2], 'last_used_at', ARGV[3])
+return 1
+`)
+
+// signRefreshToken issues the refresh token identified by tokenID in the
+// session's family. All tokens in a family share the session's expiry.
+func (s *Server) signRefreshToken(session *Session, tokenID string) (string, error) {
+	claims := &refreshClaims{
+		UserID:    session.UserID,
+		DeviceID:  session.DeviceID,
+		SessionID: session.ID,
+		TokenType: appmiddleware.TokenTypeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    s.Cfg.JWT.Issuer,
+			Audience:  []string{s.Cfg.JWT.Audience},
+			ID:        tokenID,
+		},
+	}
+
+	tokenString, err := s.Keys.Sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return tokenString, nil
+}
+
+// parseRefreshToken verifies a refresh token's signature and claims
+func (s *Server) parseRefreshToken(tokenString string) (*parsedRefreshToken, error) {
+	claims := &refreshClaims{}
+	if _, err := s.parseToken(tokenString, claims); err != nil {
+		return nil, fmt.Errorf("invalid refresh token: %w", err)
+	}
+
+	// Check token type
+	if claims.TokenType != appmiddleware.TokenTypeRefresh {
+		return nil, fmt.Errorf("invalid token type")
+	}
+
+	if claims.UserID == 0 {
+		return nil, fmt.Errorf("invalid user ID in token")
+	}
+	if claims.SessionID == "" || claims.ID == "" {
+		return nil, fmt.Errorf("invalid session ID in token")
+	}
+
+	return &parsedRefreshToken{
+		UserID:    claims.UserID,
+		SessionID: claims.SessionID,
+		TokenID:   claims.ID,
+	}, nil
+}
+
+// IssueTokenPair starts a session on the claims' device and issues its
+// first access and refresh tokens
+func (s *Server) IssueTokenPair(claims Claims) (*TokenPair, error) {
+	base := claims.Base()
+
+	// Clients that send no device ID each get their own, or every one of
+	// them would replace the previous one's session
+	if base.DeviceID == "" {
+		deviceID, err := newTokenID()
+		if err != nil {
+			return nil, err
+		}
+		base.DeviceID = deviceID
+	}
+
+	refreshToken, err := s.GenerateDeviceRefreshToken(base.UserID, base.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.IssueAccessToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    s.accessExpiresIn(),
+		DeviceID:     base.DeviceID,
+	}, nil
+}
+
+// accessExpiresIn is the access token lifetime in seconds
+func (s *Server) accessExpiresIn() int64 {
+	return int64(time.Duration(s.Cfg.JWT.AccessExpiry) * time.Minute / time.Second)
+}
+
+// RefreshTokens exchanges a refresh token for a new access and refresh
+// token pair. The presented token is consumed; presenting it again revokes
+// the whole token family and returns ErrRefreshTokenReused.
+func (s *Server) RefreshTokens(ctx context.Context, tokenString string, load SubjectLoader) (*TokenPair, error) {
+	rt, err := s.parseRefreshToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.loadSession(ctx, rt.UserID, rt.SessionID)
+	if err == redis.Nil {
+		return nil, fmt.Errorf("refresh token has been revoked")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("refresh token not found: %w", err)
+	}
+
+	if err := s.checkSessionWatermark(ctx, session); err != nil {
+		return nil, err
+	}
+
+	// Load the user before consuming the token so a failed lookup leaves
+	// the client able to retry
+	claims, err := load(ctx, rt.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+
+	nextID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Consume the presented token atomically so concurrent exchanges of
+	// the same token cannot both succeed
+	result, err := rotateRefreshScript.Run(ctx, s.Redis.Client,
+		[]string{sessionKey(rt.UserID, rt.SessionID)},
+		rt.TokenID, nextID, time.Now().Unix(),
+	).Int()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	switch result {
+	case 0:
+		return nil, fmt.Errorf("refresh token has been revoked")
+	case -1:
+		return nil, s.refreshTokenReused(ctx, rt, session)
+	}
+
+	// The session, not the loader, decides who and where the token is for
+	claims.Base().UserID = rt.UserID
+	claims.Base().DeviceID = session.DeviceID
+
+	accessToken, err := s.IssueAccessToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := s.signRefreshToken(session, nextID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    s.accessExpiresIn(),
+		DeviceID:     session.DeviceID,
+	}, nil
+}
+
+// refreshTokenReused revokes the family of a replayed refresh token. Either
+// the legitimate client or an attacker holds the newer token, and there is
+// no way to tell which, so both lose access.
+func (s *Server) refreshTokenReused(ctx context.Context, rt *parsedRefreshToken, session *Session) error {
+	logger.SecurityEvent("refresh_token_reuse",
+		zap.Uint("user_id", rt.UserID),
+		zap.String("session_id", rt.SessionID),
+		zap.String("device_id", session.DeviceID),
+		zap.String("token_id", rt.TokenID),
+	)
+
+	if err := s.RevokeSession(ctx, rt.UserID, rt.SessionID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
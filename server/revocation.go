@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrTokenRevoked is returned for access tokens that were revoked before
+// they expired
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// revokedAccessKey marks a single access token as revoked until it expires
+func revokedAccessKey(tokenID string) string {
+	return fmt.Sprintf("revoked_access:%s", tokenID)
+}
+
+// tokensValidAfterKey holds the per-user watermark: tokens issued before
+// it are rejected
+func tokensValidAfterKey(userID uint) string {
+	return fmt.Sprintf("tokens_valid_after:%d", userID)
+}
+
+// RevokeAccessToken denylists an access token for the rest of its lifetime
+func (s *Server) RevokeAccessToken(ctx context.Context, claims *JWTClaims) error {
+	if claims.ID == "" {
+		return fmt.Errorf("access token has no jti")
+	}
+
+	ttl := time.Minute
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	if ttl <= 0 {
+		// Already expired, nothing to revoke
+		return nil
+	}
+
+	if err := s.Redis.Client.Set(ctx, revokedAccessKey(claims.ID), 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+	return nil
+}
+
+// RevokeTokensIssuedBefore invalidates every access token issued to the
+// user before t, and every session started before t. Use it on password
+// changes and account lockouts. The watermark has one second resolution;
+// tokens issued within the same second as t stay valid.
+func (s *Server) RevokeTokensIssuedBefore(ctx context.Context, userID uint, t time.Time) error {
+	// Keep the watermark as long as any affected token could still be valid
+	ttl := time.Duration(s.Cfg.JWT.AccessExpiry) * time.Minute
+	if refresh := time.Duration(s.Cfg.JWT.RefreshExpiry) * 24 * time.Hour; refresh > ttl {
+		ttl = refresh
+	}
+	ttl -= time.Since(t)
+	if ttl <= 0 {
+		return nil
+	}
+
+	// Never move the watermark backwards
+	key := tokensValidAfterKey(userID)
+	current, err := s.tokensValidAfter(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !current.IsZero() && current.After(t) {
+		return nil
+	}
+
+	if err := s.Redis.Client.Set(ctx, key, t.Unix(), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set token watermark: %w", err)
+	}
+	return nil
+}
+
+// tokensValidAfter returns the user's watermark, or the zero time if none
+func (s *Server) tokensValidAfter(ctx context.Context, userID uint) (time.Time, error) {
+	value, err := s.Redis.Client.Get(ctx, tokensValidAfterKey(userID)).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read token watermark: %w", err)
+	}
+
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid token watermark %q", value)
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// checkAccessToken returns an error if the access token was revoked
+// individually or falls below the user's watermark
+func (s *Server) checkAccessToken(ctx context.Context, claims *JWTClaims) error {
+	var denied *redis.IntCmd
+	var watermarks []*redis.StringCmd
+	_, err := s.Redis.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if claims.ID != "" {
+			denied = pipe.Exists(ctx, revokedAccessKey(claims.ID))
+		}
+		watermarks = append(watermarks, pipe.Get(ctx, tokensValidAfterKey(claims.UserID)))
+		// Revoking the admin's tokens also ends their impersonations
+		if claims.Act != nil {
+			watermarks = append(watermarks, pipe.Get(ctx, tokensValidAfterKey(claims.Act.UserID)))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to check token revocation: %w", err)
+	}
+
+	// Pipelined reports only the first failed command, and a missing
+	// watermark fails with redis.Nil, so every command is checked on its own
+	if denied != nil {
+		if err := denied.Err(); err != nil {
+			return fmt.Errorf("failed to check token revocation: %w", err)
+		}
+		if denied.Val() > 0 {
+			return ErrTokenRevoked
+		}
+	}
+
+	for _, watermark := range watermarks {
+		value, err := watermark.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read token watermark: %w", err)
+		}
+		unix, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid token watermark %q", value)
+		}
+		if claims.IssuedAt == nil || claims.IssuedAt.Unix() < unix {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
+
+// checkSessionWatermark returns an error if the session was started before
+// the user's watermark
+func (s *Server) checkSessionWatermark(ctx context.Context, session *Session) error {
+	validAfter, err := s.tokensValidAfter(ctx, session.UserID)
+	if err != nil {
+		return err
+	}
+	if !validAfter.IsZero() && session.CreatedAt.Before(validAfter) {
+		return fmt.Errorf("refresh token has been revoked")
+	}
+	return nil
+}
+
+// revocationMiddleware rejects revoked access tokens. It runs after the
+// echojwt middleware has verified the token.
+func (s *Server) revocationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, err := accessClaims(c)
+		if err != nil {
+			return unauthorized(c, err)
+		}
+		err = s.checkAccessToken(c.Request().Context(), claims)
+		if errors.Is(err, ErrTokenRevoked) {
+			return unauthorized(c, err)
+		}
+		if err != nil {
+			// Fail closed without blaming the client's token
+			return serviceUnavailable(c, err)
+		}
+		return next(c)
+	}
+}
+
+// accessClaims returns the claims the echojwt middleware stored in the context
+func accessClaims(c echo.Context) (*JWTClaims, error) {
+	claims, ok := appmiddleware.ClaimsFromContext(c)
+	if !ok {
+		return nil, fmt.Errorf("missing token claims")
+	}
+	return claims, nil
+}
+
+func serviceUnavailable(c echo.Context, err error) error {
+	return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+		"code":    http.StatusServiceUnavailable,
+		"message": "service unavailable",
+		"error":   err.Error(),
+	})
+}
+
+func unauthorized(c echo.Context, err error) error {
+	return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+		"code":    http.StatusUnauthorized,
+		"message": "unauthorized",
+		"error":   err.Error(),
+	})
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckAccessTokenFailsClosedOnWatermarkErrors(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	claims := &JWTClaims{
+		UserID:           1,
+		Act:              &Actor{UserID: 2},
+		RegisteredClaims: jwt.RegisteredClaims{ID: "token-1", IssuedAt: jwt.NewNumericDate(time.Now())},
+	}
+
+	if err := s.checkAccessToken(ctx, claims); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+
+	// The user's watermark is missing, which the pipeline reports as its
+	// first error, while reading the impersonator's fails
+	if err := s.Redis.Client.HSet(ctx, tokensValidAfterKey(2), "not", "a string").Err(); err != nil {
+		t.Fatalf("HSet: %v", err)
+	}
+	err := s.checkAccessToken(ctx, claims)
+	if err == nil || errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("watermark read error: got %v, want a lookup error", err)
+	}
+
+	if err := s.Redis.Client.Del(ctx, tokensValidAfterKey(2)).Err(); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if err := s.RevokeAccessToken(ctx, claims); err != nil {
+		t.Fatalf("RevokeAccessToken: %v", err)
+	}
+	if err := s.checkAccessToken(ctx, claims); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked token: got %v, want ErrTokenRevoked", err)
+	}
+}
+
+func TestLogoutAllRevokesAccessTokens(t *testing.T) {
+	s := newTestServer(t)
+	s.MountAuth(testAuthenticator{}, AuthOptions{})
+	ctx := context.Background()
+
+	pair, err := s.IssueTokenPair(&JWTClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	// Issued on another device before the logout
+	earlier := &JWTClaims{
+		UserID:           1,
+		RegisteredClaims: jwt.RegisteredClaims{ID: "token-2", IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/logout",
+		strings.NewReader(`{"refresh_token":"`+pair.RefreshToken+`","all":true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if err := s.checkAccessToken(ctx, earlier); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("access token from another device: got %v, want ErrTokenRevoked", err)
+	}
+	if _, err := s.ValidateRefreshSession(ctx, pair.RefreshToken); err == nil {
+		t.Error("refresh token still valid")
+	}
+}
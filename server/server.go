@@ -3,16 +3,22 @@ package server
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/1827mk/app-commons/conf"
+	"github.com/1827mk/app-server/apikey"
 	"github.com/1827mk/app-server/datastore"
 	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/1827mk/app-server/quota"
 	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
@@ -21,35 +27,114 @@ type Server struct {
 	Cfg      *conf.Config
 	Database *datastore.DBStore
 	Redis    *datastore.RedisClient
+	Keys     *KeyRing
+	// API is the /api route group; its routes require a valid access token
+	API *echo.Group
+	// APIKeys issues and verifies API keys. It is nil unless the server was
+	// created with WithAPIKeys.
+	APIKeys *apikey.Repository
+	// Quotas meters /api requests against usage quotas. It is nil unless
+	// the server was created with WithQuotas.
+	Quotas *quota.Meter
+
+	policy     *appmiddleware.Policy
+	newClaims  func() Claims
+	validation TokenValidation
+
+	apiKeyConfig *apikey.Config
+	loadKeyOwner SubjectLoader
+
+	tlsConfig   *TLSConfig
+	certs       *certReloader
+	clientCerts *appmiddleware.ClientCertConfig
+
+	migrations           fs.FS
+	migrationLockTimeout time.Duration
+	configureDB          []func(*datastore.DBConfig)
+	startupRetry         datastore.RetryConfig
+
+	// degradedStart connects to the database and Redis in the background;
+	// ready is set once both are connected
+	degradedStart  bool
+	ready          atomic.Bool
+	stopConnecting context.CancelFunc
+	// startupErr is why a degraded start gave up
+	startupErr atomic.Pointer[error]
+
+	rateLimits  *appmiddleware.RateLimitPolicy
+	quotaConfig *quota.Config
+
+	// requireAccessToken authenticates a request by its access token
+	requireAccessToken []echo.MiddlewareFunc
 }
 
 // JWTClaims defines the structure for JWT token claims
-type JWTClaims struct {
-	UserID   uint   `json:"user_id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	jwt.RegisteredClaims
-}
+type JWTClaims = appmiddleware.JWTClaims
+
+// Claims is implemented by JWTClaims and application claims that embed it
+type Claims = appmiddleware.Claims
 
 // Pre-configured logger
 var log *zap.Logger
 
-func NewServer(cfg *conf.Config) (*Server, error) {
+func NewServer(cfg *conf.Config, opts ...Option) (*Server, error) {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 
-	// Initialize database
-	db, err := datastore.NewPostgresDB(&datastore.DBConfig{
-		Host:     cfg.Database.Host,
-		Port:     cfg.Database.Port,
-		User:     cfg.Database.User,
-		Password: cfg.Database.Password,
-		DBName:   cfg.Database.DBName,
-		Scripts:  cfg.Database.Scripts,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("database initialization failed: %v", err)
+	server := &Server{
+		Echo: e,
+		Cfg:  cfg,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	if server.newClaims == nil {
+		server.newClaims = func() Claims { return new(JWTClaims) }
+	}
+	if server.validation.Issuer == "" {
+		server.validation.Issuer = cfg.JWT.Issuer
+	}
+	if server.validation.Audience == "" {
+		server.validation.Audience = cfg.JWT.Audience
+	}
+
+	// Fall back to the shared HS256 secret when no key ring was supplied
+	if server.Keys == nil {
+		keys, err := newSecretKeyRing(cfg.JWT.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key initialization failed: %v", err)
+		}
+		server.Keys = keys
+	}
+
+	if server.tlsConfig != nil {
+		certs, err := newCertReloader(*server.tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tls initialization failed: %v", err)
+		}
+		server.certs = certs
+	}
+
+	// Initialize database and Redis. A degraded start connects to them in
+	// the background instead and reports not ready meanwhile.
+	dbConfig, redisConfig := server.dbConfig(), server.redisConfig()
+	var db *datastore.DBStore
+	var rdb *datastore.RedisClient
+	var err error
+	if server.degradedStart {
+		if db, err = datastore.OpenPostgresDB(dbConfig); err != nil {
+			return nil, fmt.Errorf("database initialization failed: %v", err)
+		}
+		rdb = datastore.OpenRedisClient(redisConfig)
+	} else {
+		if db, err = datastore.NewPostgresDB(dbConfig); err != nil {
+			return nil, fmt.Errorf("database initialization failed: %v", err)
+		}
+		if rdb, err = datastore.NewRedisClient(redisConfig); err != nil {
+			return nil, fmt.Errorf("redis initialization failed: %v", err)
+		}
 	}
 
 	// Create datastore
@@ -60,14 +145,12 @@ func NewServer(cfg *conf.Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to create store: %v", err)
 	}
 
-	// Initialize Redis
-	rdb, err := datastore.NewRedisClient(&datastore.RedisConfig{
-		Addr:     cfg.Redis.Addr,
-		Password: cfg.Redis.Password,
-		DB:       cfg.Redis.DB,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("redis initialization failed: %v", err)
+	if server.apiKeyConfig != nil {
+		keys, err := apikey.NewRepository(store, *server.apiKeyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("api key initialization failed: %v", err)
+		}
+		server.APIKeys = keys
 	}
 
 	//create redis
@@ -82,6 +165,9 @@ func NewServer(cfg *conf.Config) (*Server, error) {
 			c.Set("store", store)
 			c.Set("redis", redis)
 			c.Set("secret_key", cfg.JWT.Secret)
+			if server.policy != nil {
+				c.Set(appmiddleware.PolicyContextKey, server.policy)
+			}
 			return next(c)
 		}
 	})
@@ -102,14 +188,38 @@ func NewServer(cfg *conf.Config) (*Server, error) {
 	})
 
 	// Configure JWT middleware
-	configureJWTMiddleware(e, cfg)
+	server.configureJWTMiddleware()
 
-	// Initialize server with all components
-	server := &Server{
-		Echo:     e,
-		Cfg:      cfg,
-		Database: db,
-		Redis:    rdb,
+	// Rate limit /api after authentication so rules can key on the caller
+	if server.rateLimits != nil {
+		store, err := appmiddleware.NewRedisRateLimiterStore(rdb.Client, appmiddleware.RateLimiterStoreConfig{})
+		if err != nil {
+			return nil, fmt.Errorf("rate limiter initialization failed: %v", err)
+		}
+		server.API.Use(appmiddleware.RateLimit(store, server.rateLimits))
+	}
+
+	if server.quotaConfig != nil {
+		meter, err := quota.NewMeter(store, rdb.Client, *server.quotaConfig)
+		if err != nil {
+			return nil, fmt.Errorf("quota initialization failed: %v", err)
+		}
+		server.Quotas = meter
+		server.API.Use(meter.Middleware())
+	}
+
+	// Publish verification keys for downstream services
+	e.GET("/.well-known/jwks.json", server.JWKSHandler)
+
+	server.Database = db
+	server.Redis = rdb
+
+	if server.degradedStart {
+		ctx, cancel := context.WithCancel(context.Background())
+		server.stopConnecting = cancel
+		go server.connect(ctx, dbConfig, redisConfig)
+	} else {
+		server.ready.Store(true)
 	}
 
 	return server, nil
@@ -144,56 +254,94 @@ func CustomRecover() echo.MiddlewareFunc {
 }
 
 // configureJWTMiddleware sets up the JWT middleware
-func configureJWTMiddleware(e *echo.Echo, cfg *conf.Config) {
+func (s *Server) configureJWTMiddleware() {
 	// Create a JWT middleware group for protected routes
-	jwtGroup := e.Group("/api")
+	s.API = s.Echo.Group("/api")
 
 	// Configure JWT middleware
 	jwtConfig := echojwt.Config{
-		NewClaimsFunc: func(c echo.Context) jwt.Claims {
-			return new(JWTClaims)
+		// Verify signature, issuer, audience and lifetime, and accept
+		// only access tokens
+		ParseTokenFunc: func(c echo.Context, auth string) (interface{}, error) {
+			return s.parseAccessToken(auth)
+		},
+		// Browser clients of the auth endpoints send the token as a cookie
+		TokenLookup: "header:Authorization:Bearer ,cookie:" + accessTokenCookie,
+		// Expose the parsed claims to ClaimsFromContext
+		SuccessHandler: func(c echo.Context) {
+			if token, ok := c.Get("user").(*jwt.Token); ok {
+				c.Set(appmiddleware.ClaimsContextKey, token.Claims)
+			}
 		},
-		SigningKey:    []byte(cfg.JWT.Secret),
-		SigningMethod: "HS256",
-		TokenLookup:   "header:Authorization:Bearer ",
 		ErrorHandler: func(c echo.Context, err error) error {
-			return c.JSON(401, map[string]interface{}{
-				"code":    401,
-				"message": "unauthorized",
-				"error":   err.Error(),
-			})
+			return unauthorized(c, err)
 		},
 	}
 
-	// Apply JWT middleware to protected routes
-	jwtGroup.Use(echojwt.WithConfig(jwtConfig))
+	// Apply JWT middleware to protected routes, then reject revoked tokens
+	s.requireAccessToken = []echo.MiddlewareFunc{echojwt.WithConfig(jwtConfig), s.revocationMiddleware}
+	if s.APIKeys != nil {
+		s.requireAccessToken = []echo.MiddlewareFunc{s.apiKeyOr(s.requireAccessToken...)}
+	}
+	// Client certificates identify services, not users, so they are only
+	// accepted on /api and never on the /auth credential endpoints
+	requireAPICaller := s.requireAccessToken
+	if s.clientCerts != nil {
+		requireAPICaller = []echo.MiddlewareFunc{s.clientCertOr(s.requireAccessToken...)}
+	}
+	s.API.Use(requireAPICaller...)
+
+	// Record who is behind each request, including impersonating admins
+	s.API.Use(s.identifyCaller)
+	s.requireAccessToken = append(s.requireAccessToken, s.identifyCaller)
 }
 
 // GenerateJWTToken creates a new JWT token for a user
 func (s *Server) GenerateJWTToken(userID uint, username, role string) (string, error) {
-	// Set expiry time based on configuration
-	expiryTime := time.Now().Add(time.Duration(s.Cfg.JWT.AccessExpiry) * time.Minute)
-
-	// Create claims
-	claims := &JWTClaims{
+	return s.IssueAccessToken(&JWTClaims{
 		UserID:   userID,
 		Username: username,
 		Role:     role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiryTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    s.Cfg.JWT.Issuer,
-			Subject:   username,
-			Audience:  []string{s.Cfg.JWT.Audience},
-		},
+	})
+}
+
+// IssueAccessToken signs an access token for claims, which may be the
+// application's registered claims type. The registered claims (expiry,
+// issuer, audience, jti) are filled in from configuration.
+func (s *Server) IssueAccessToken(claims Claims) (string, error) {
+	return s.signClaims(claims, appmiddleware.TokenTypeAccess,
+		time.Duration(s.Cfg.JWT.AccessExpiry)*time.Minute)
+}
+
+// signClaims stamps claims with the token type and registered claims and
+// signs them with the active key
+func (s *Server) signClaims(claims Claims, tokenType string, lifetime time.Duration) (string, error) {
+	now := time.Now()
+
+	// Give every token a jti so it can be revoked individually
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	base := claims.Base()
+	base.TokenType = tokenType
+	subject := base.Subject
+	if subject == "" {
+		subject = base.Username
+	}
+	base.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Issuer:    s.Cfg.JWT.Issuer,
+		Subject:   subject,
+		Audience:  []string{s.Cfg.JWT.Audience},
+		ID:        tokenID,
+	}
 
-	// Generate encoded token
-	tokenString, err := token.SignedString([]byte(s.Cfg.JWT.Secret))
+	// Sign with the active key, stamping its kid
+	tokenString, err := s.Keys.Sign(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate JWT token: %w", err)
 	}
@@ -201,105 +349,164 @@ func (s *Server) GenerateJWTToken(userID uint, username, role string) (string, e
 	return tokenString, nil
 }
 
-// GenerateRefreshToken creates a new refresh token
+// GenerateRefreshToken starts a new session for the user on a device of
+// its own and returns its refresh token
 func (s *Server) GenerateRefreshToken(userID uint) (string, error) {
-	// Generate a unique refresh token
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
+	return s.GenerateDeviceRefreshToken(userID, "")
+}
 
-	// Set claims
-	claims := refreshToken.Claims.(jwt.MapClaims)
-	claims["user_id"] = userID
-	claims["exp"] = time.Now().Add(time.Duration(s.Cfg.JWT.RefreshExpiry) * 24 * time.Hour).Unix()
-	claims["token_type"] = "refresh"
+// GenerateDeviceRefreshToken starts a new session for the user's device and
+// returns its refresh token. Any previous session on the same device is
+// replaced; sessions on other devices are unaffected. An empty deviceID
+// starts a session on a new device.
+func (s *Server) GenerateDeviceRefreshToken(userID uint, deviceID string) (string, error) {
+	ttl := time.Duration(s.Cfg.JWT.RefreshExpiry) * 24 * time.Hour
 
-	// Generate encoded token
-	tokenString, err := refreshToken.SignedString([]byte(s.Cfg.JWT.Secret))
-	if err != nil {
-		return "", fmt.Errorf("failed to generate refresh token: %w", err)
-	}
-
-	// Store refresh token in Redis with expiry
+	// Store the session in Redis with expiry
 	ctx := context.Background()
-	err = s.Redis.Client.Set(
-		ctx,
-		fmt.Sprintf("refresh_token:%d", userID),
-		tokenString,
-		time.Duration(s.Cfg.JWT.RefreshExpiry)*24*time.Hour,
-	).Err()
+	session, err := s.createSession(ctx, userID, deviceID, ttl)
 	if err != nil {
 		return "", fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
-	return tokenString, nil
+	return s.signRefreshToken(session, session.tokenID)
 }
 
-// ValidateRefreshToken validates a refresh token
+// ValidateRefreshToken validates a refresh token and returns its user ID
 func (s *Server) ValidateRefreshToken(tokenString string) (uint, error) {
-	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(s.Cfg.JWT.Secret), nil
-	})
-
+	session, err := s.ValidateRefreshSession(context.Background(), tokenString)
 	if err != nil {
-		return 0, fmt.Errorf("invalid refresh token: %w", err)
+		return 0, err
 	}
+	return session.UserID, nil
+}
 
-	// Verify token is valid
-	if !token.Valid {
-		return 0, fmt.Errorf("invalid refresh token")
+// ValidateRefreshSession validates a refresh token without consuming it and
+// returns the session it belongs to
+func (s *Server) ValidateRefreshSession(ctx context.Context, tokenString string) (*Session, error) {
+	rt, err := s.parseRefreshToken(tokenString)
+	if err != nil {
+		return nil, err
 	}
 
-	// Extract claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return 0, fmt.Errorf("invalid token claims")
+	// Verify the session still exists in Redis
+	session, err := s.loadSession(ctx, rt.UserID, rt.SessionID)
+	if err == redis.Nil {
+		return nil, fmt.Errorf("refresh token has been revoked")
 	}
-
-	// Check token type
-	tokenType, ok := claims["token_type"].(string)
-	if !ok || tokenType != "refresh" {
-		return 0, fmt.Errorf("invalid token type")
+	if err != nil {
+		return nil, fmt.Errorf("refresh token not found: %w", err)
 	}
 
-	// Get user ID from claims
-	userIDFloat, ok := claims["user_id"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("invalid user ID in token")
+	// Only the newest token of the family is valid
+	if session.tokenID != rt.TokenID {
+		return nil, s.refreshTokenReused(ctx, rt, session)
 	}
-	userID := uint(userIDFloat)
 
-	// Verify against stored token in Redis
-	ctx := context.Background()
-	storedToken, err := s.Redis.Client.Get(ctx, fmt.Sprintf("refresh_token:%d", userID)).Result()
-	if err != nil {
-		return 0, fmt.Errorf("refresh token not found: %w", err)
+	if err := s.checkSessionWatermark(ctx, session); err != nil {
+		return nil, err
 	}
 
-	if storedToken != tokenString {
-		return 0, fmt.Errorf("refresh token has been revoked")
+	err = s.touchSession(ctx, session)
+	if err == redis.Nil {
+		return nil, fmt.Errorf("refresh token has been revoked")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update session: %w", err)
 	}
 
-	return userID, nil
+	return session, nil
 }
 
-// RevokeRefreshToken invalidates a refresh token
+// RevokeRefreshToken invalidates every refresh token of a user
 func (s *Server) RevokeRefreshToken(userID uint) error {
-	ctx := context.Background()
-	err := s.Redis.Client.Del(ctx, fmt.Sprintf("refresh_token:%d", userID)).Err()
-	if err != nil {
+	if err := s.RevokeAllSessions(context.Background(), userID); err != nil {
 		return fmt.Errorf("failed to revoke refresh token: %w", err)
 	}
 	return nil
 }
 
+// Migrate runs the database init scripts and migrations configured by cfg
+// and opts, then closes the connection. Nothing else is started, so a
+// deploy job can migrate once before the replicas roll out.
+func Migrate(cfg *conf.Config, opts ...Option) error {
+	server := &Server{Cfg: cfg}
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	db, err := datastore.NewPostgresDB(server.dbConfig())
+	if err != nil {
+		return fmt.Errorf("database migration failed: %v", err)
+	}
+	return db.DB.Close()
+}
+
+func (s *Server) dbConfig() *datastore.DBConfig {
+	cfg := &datastore.DBConfig{
+		Host:     s.Cfg.Database.Host,
+		Port:     s.Cfg.Database.Port,
+		User:     s.Cfg.Database.User,
+		Password: s.Cfg.Database.Password,
+		DBName:   s.Cfg.Database.DBName,
+		Scripts:  s.Cfg.Database.Scripts,
+		// Numbered migrations run after the legacy init scripts
+		Migrations:           s.migrations,
+		MigrationLockTimeout: s.migrationLockTimeout,
+		Retry:                s.startupRetry,
+	}
+	for _, configure := range s.configureDB {
+		configure(cfg)
+	}
+	return cfg
+}
+
+func (s *Server) redisConfig() *datastore.RedisConfig {
+	return &datastore.RedisConfig{
+		Addr:     s.Cfg.Redis.Addr,
+		Password: s.Cfg.Redis.Password,
+		DB:       s.Cfg.Redis.DB,
+		Retry:    s.startupRetry,
+	}
+}
+
 func (s *Server) Start() error {
-	return s.Echo.Start(fmt.Sprintf(":%v", s.Cfg.Server.Port))
+	addr := fmt.Sprintf(":%v", s.Cfg.Server.Port)
+	var err error
+	if s.certs != nil {
+		err = s.startTLS(addr)
+	} else {
+		err = s.Echo.Start(addr)
+	}
+	// A degraded start that could not complete shuts the server down
+	if failure := s.startupFailure(); failure != nil {
+		return failure
+	}
+	return err
 }
 
 func (s *Server) Stop(ctx context.Context) error {
-	return s.Echo.Shutdown(ctx)
+	if s.stopConnecting != nil {
+		s.stopConnecting()
+	}
+	if s.certs != nil {
+		s.certs.stop()
+	}
+	if err := s.Echo.Shutdown(ctx); err != nil {
+		return err
+	}
+	// Flush usage after the last request has been served
+	if s.Quotas != nil {
+		return s.Quotas.Stop(ctx)
+	}
+	return nil
+}
+
+// Usage returns the current day and month usage of identity, such as
+// quota.UserIdentity(userID), with the quotas of plan
+func (s *Server) Usage(ctx context.Context, identity, plan string) (*quota.Usage, error) {
+	if s.Quotas == nil {
+		return nil, fmt.Errorf("quotas are not enabled")
+	}
+	return s.Quotas.Usage(ctx, identity, plan)
 }
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Session is a refresh token session for one user on one device
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uint      `json:"user_id"`
+	DeviceID   string    `json:"device_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	// tokenID is the jti of the only refresh token in the family that may
+	// still be exchanged
+	tokenID string
+}
+
+// sessionKey holds a single session as a Redis hash
+func sessionKey(userID uint, sessionID string) string {
+	return fmt.Sprintf("refresh_session:%d:%s", userID, sessionID)
+}
+
+// sessionIndexKey holds the set of a user's session IDs
+func sessionIndexKey(userID uint) string {
+	return fmt.Sprintf("refresh_sessions:%d", userID)
+}
+
+// newTokenID returns a random identifier for sessions and refresh tokens
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createSession starts a new refresh token family for the device, replacing
+// any session the device already had and evicting the least recently used
+// sessions beyond the configured device limit
+func (s *Server) createSession(ctx context.Context, userID uint, deviceID string, ttl time.Duration) (*Session, error) {
+	if deviceID == "" {
+		// An unnamed device must not replace another unnamed device
+		id, err := newTokenID()
+		if err != nil {
+			return nil, err
+		}
+		deviceID = id
+	}
+
+	sessions, err := s.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	others := sessions[:0]
+	for _, session := range sessions {
+		if session.DeviceID == deviceID {
+			stale = append(stale, session.ID)
+			continue
+		}
+		others = append(others, session)
+	}
+	if max := s.Cfg.Auth.MaxDevices; max > 0 && len(others) >= max {
+		// ListSessions returns the most recently used first
+		for _, session := range others[max-1:] {
+			stale = append(stale, session.ID)
+		}
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	tokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         sessionID,
+		UserID:     userID,
+		DeviceID:   deviceID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(ttl),
+		tokenID:    tokenID,
+	}
+
+	_, err = s.Redis.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range stale {
+			pipe.Del(ctx, sessionKey(userID, id))
+			pipe.SRem(ctx, sessionIndexKey(userID), id)
+		}
+		pipe.HSet(ctx, sessionKey(userID, sessionID), map[string]interface{}{
+			"device_id":    deviceID,
+			"jti":          tokenID,
+			"created_at":   now.Unix(),
+			"last_used_at": now.Unix(),
+			"expires_at":   session.ExpiresAt.Unix(),
+		})
+		pipe.Expire(ctx, sessionKey(userID, sessionID), ttl)
+		pipe.SAdd(ctx, sessionIndexKey(userID), sessionID)
+		pipe.Expire(ctx, sessionIndexKey(userID), ttl)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+
+	return session, nil
+}
+
+// loadSession fetches a session, returning redis.Nil if it no longer exists
+func (s *Server) loadSession(ctx context.Context, userID uint, sessionID string) (*Session, error) {
+	fields, err := s.Redis.Client.HGetAll(ctx, sessionKey(userID, sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+	return sessionFromHash(userID, sessionID, fields), nil
+}
+
+// touchSessionScript updates last_used_at only while the session exists,
+// so a session revoked meanwhile is not recreated without its expiry or
+// index entry. Returns 1 when touched and 0 when the session is gone.
+var touchSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_used_at', ARGV[1])
+return 1
+`)
+
+// touchSession records that the session's refresh token was just used. It
+// returns redis.Nil if the session no longer exists.
+func (s *Server) touchSession(ctx context.Context, session *Session) error {
+	session.LastUsedAt = time.Now()
+	touched, err := touchSessionScript.Run(ctx, s.Redis.Client,
+		[]string{sessionKey(session.UserID, session.ID)},
+		session.LastUsedAt.Unix(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if touched == 0 {
+		return redis.Nil
+	}
+	return nil
+}
+
+func sessionFromHash(userID uint, sessionID string, fields map[string]string) *Session {
+	unix := func(name string) time.Time {
+		v, _ := strconv.ParseInt(fields[name], 10, 64)
+		return time.Unix(v, 0)
+	}
+	return &Session{
+		ID:         sessionID,
+		UserID:     userID,
+		DeviceID:   fields["device_id"],
+		CreatedAt:  unix("created_at"),
+		LastUsedAt: unix("last_used_at"),
+		ExpiresAt:  unix("expires_at"),
+		tokenID:    fields["jti"],
+	}
+}
+
+// ListSessions returns a user's active sessions, most recently used first
+func (s *Server) ListSessions(ctx context.Context, userID uint) ([]Session, error) {
+	ids, err := s.Redis.Client.SMembers(ctx, sessionIndexKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = s.Redis.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, sessionKey(userID, id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	sessions := make([]Session, 0, len(ids))
+	var expired []interface{}
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			// The session hash expired but is still indexed
+			expired = append(expired, ids[i])
+			continue
+		}
+		sessions = append(sessions, *sessionFromHash(userID, ids[i], fields))
+	}
+
+	if len(expired) > 0 {
+		if err := s.Redis.Client.SRem(ctx, sessionIndexKey(userID), expired...).Err(); err != nil {
+			return nil, fmt.Errorf("failed to prune expired sessions: %w", err)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession logs a single device out by invalidating its refresh token
+func (s *Server) RevokeSession(ctx context.Context, userID uint, sessionID string) error {
+	_, err := s.Redis.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(userID, sessionID))
+		pipe.SRem(ctx, sessionIndexKey(userID), sessionID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// RevokeAllSessions logs a user out everywhere
+func (s *Server) RevokeAllSessions(ctx context.Context, userID uint) error {
+	ids, err := s.Redis.Client.SMembers(ctx, sessionIndexKey(userID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, sessionKey(userID, id))
+	}
+	keys = append(keys, sessionIndexKey(userID))
+
+	if err := s.Redis.Client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLoginsWithoutDeviceIDKeepSeparateSessions(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	first, err := s.IssueTokenPair(&JWTClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	second, err := s.IssueTokenPair(&JWTClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	if first.DeviceID == "" || first.DeviceID == second.DeviceID {
+		t.Fatalf("device IDs %q and %q", first.DeviceID, second.DeviceID)
+	}
+
+	sessions, err := s.ListSessions(ctx, 1)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	if _, err := s.ValidateRefreshSession(ctx, first.RefreshToken); err != nil {
+		t.Errorf("first session: %v", err)
+	}
+
+	// Logging in again with the returned device ID replaces its session
+	third, err := s.IssueTokenPair(&JWTClaims{UserID: 1, DeviceID: first.DeviceID})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	if third.DeviceID != first.DeviceID {
+		t.Errorf("device ID = %q, want %q", third.DeviceID, first.DeviceID)
+	}
+	if _, err := s.ValidateRefreshSession(ctx, first.RefreshToken); err == nil {
+		t.Error("replaced session is still valid")
+	}
+}
+
+func TestTouchDoesNotRecreateRevokedSession(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	pair, err := s.IssueTokenPair(&JWTClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	session, err := s.ValidateRefreshSession(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("ValidateRefreshSession: %v", err)
+	}
+
+	// Revoked between the read and the touch
+	if err := s.RevokeSession(ctx, session.UserID, session.ID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := s.touchSession(ctx, session); err == nil {
+		t.Error("touched a revoked session")
+	}
+
+	exists, err := s.Redis.Client.Exists(ctx, sessionKey(session.UserID, session.ID)).Result()
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	if exists != 0 {
+		t.Error("revoked session was recreated")
+	}
+}
+
+func TestGenerateRefreshTokenStartsSessionOnNewDevice(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	first, err := s.GenerateRefreshToken(1)
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken: %v", err)
+	}
+	second, err := s.GenerateRefreshToken(1)
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken: %v", err)
+	}
+	for _, token := range []string{first, second} {
+		if userID, err := s.ValidateRefreshToken(token); err != nil || userID != 1 {
+			t.Errorf("ValidateRefreshToken = %d, %v", userID, err)
+		}
+	}
+	if sessions, err := s.ListSessions(ctx, 1); err != nil || len(sessions) != 2 {
+		t.Errorf("ListSessions = %d sessions, %v; want 2", len(sessions), err)
+	}
+}
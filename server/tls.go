@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Client certificate modes for TLSConfig.ClientAuth
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// TLSConfig enables HTTPS and, optionally, client certificate verification
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile is a PEM bundle of the CAs that issue client certificates
+	ClientCAFile string `yaml:"clientCAFile"`
+	// ClientAuth is none, request (verify a certificate if one is sent) or
+	// require. Defaults to require when ClientCAFile is set.
+	ClientAuth string `yaml:"clientAuth"`
+	// ReloadInterval is how often the files are checked for changes.
+	// Defaults to one minute.
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// certReloader serves the certificate and client CAs from disk and picks up
+// replaced files without a restart
+type certReloader struct {
+	cfg TLSConfig
+
+	// stop ends watch
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("tls requires a certificate and key file")
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = time.Minute
+	}
+	if cfg.ClientAuth == "" {
+		cfg.ClientAuth = ClientAuthNone
+		if cfg.ClientCAFile != "" {
+			cfg.ClientAuth = ClientAuthRequire
+		}
+	}
+	switch cfg.ClientAuth {
+	case ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", cfg.ClientAuth)
+	}
+	if cfg.ClientAuth != ClientAuthNone && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("client certificate verification requires a client CA file")
+	}
+
+	r := &certReloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.ctx, r.stop = context.WithCancel(context.Background())
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// load reads every file; on error the previous certificates stay in use
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether any file was modified since the last load
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Mid-replacement; try again on the next tick
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads changed files until stop is called
+func (r *certReloader) watch() {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				logger.Logger().Error("Failed to reload TLS certificates", logger.WithError(err))
+				continue
+			}
+			logger.Logger().Info("Reloaded TLS certificates", zap.String("cert_file", r.cfg.CertFile))
+		}
+	}
+}
+
+// tlsConfig builds a server config that reads the current certificates on
+// every handshake
+func (r *certReloader) tlsConfig() *tls.Config {
+	var clientAuth tls.ClientAuthType
+	switch r.cfg.ClientAuth {
+	case ClientAuthRequest:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		clientAuth = tls.NoClientCert
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*r.cert}
+		cfg.ClientAuth = clientAuth
+		cfg.ClientCAs = r.clientCAs
+		return cfg, nil
+	}
+	return base
+}
+
+// startTLS serves HTTPS, reloading certificates until the server stops
+func (s *Server) startTLS(addr string) error {
+	go s.certs.watch()
+
+	srv := s.Echo.TLSServer
+	srv.Addr = addr
+	srv.TLSConfig = s.certs.tlsConfig()
+	return s.Echo.StartServer(srv)
+}
+
+// clientCertOr authenticates requests presenting a verified client
+// certificate, and no token, by the certificate, and every other request
+// with the token middleware chain
+func (s *Server) clientCertOr(token ...echo.MiddlewareFunc) echo.MiddlewareFunc {
+	cfg := *s.clientCerts
+	// The token chain rejects requests without credentials
+	cfg.Required = false
+	viaCert := appmiddleware.ClientCertAuth(cfg)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		viaToken := next
+		for i := len(token) - 1; i >= 0; i-- {
+			viaToken = token[i](viaToken)
+		}
+		viaCert := viaCert(next)
+
+		return func(c echo.Context) error {
+			state := c.Request().TLS
+			if state == nil || len(state.VerifiedChains) == 0 || s.carriesToken(c) {
+				return viaToken(c)
+			}
+			return viaCert(c)
+		}
+	}
+}
+
+// carriesToken reports whether the request brings a bearer token, access
+// token cookie or API key
+func (s *Server) carriesToken(c echo.Context) bool {
+	req := c.Request()
+	if req.Header.Get(echo.HeaderAuthorization) != "" {
+		return true
+	}
+	if s.APIKeys != nil && req.Header.Get(APIKeyHeader) != "" {
+		return true
+	}
+	_, err := req.Cookie(accessTokenCookie)
+	return err == nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1827mk/app-server/apikey"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientCertAuthenticatesAPIRequests(t *testing.T) {
+	s := newTestServer(t)
+	s.clientCerts = &appmiddleware.ClientCertConfig{}
+	s.configureJWTMiddleware()
+	s.API.GET("/whoami", func(c echo.Context) error {
+		claims, _ := appmiddleware.ClaimsFromContext(c)
+		return c.String(http.StatusOK, claims.TokenType+":"+claims.Username)
+	})
+
+	token, err := s.IssueAccessToken(&JWTClaims{UserID: 1, Username: "alice"})
+	if err != nil {
+		t.Fatalf("IssueAccessToken: %v", err)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+		Subject:      pkix.Name{CommonName: "billing"},
+		SerialNumber: big.NewInt(7),
+	}}}}
+
+	for _, tc := range []struct {
+		name   string
+		tls    *tls.ConnectionState
+		token  string
+		status int
+		body   string
+	}{
+		{"certificate", verified, "", http.StatusOK, appmiddleware.TokenTypeClientCert + ":billing"},
+		{"certificate and token", verified, token, http.StatusOK, appmiddleware.TokenTypeAccess + ":alice"},
+		{"token", nil, token, http.StatusOK, appmiddleware.TokenTypeAccess + ":alice"},
+		{"unverified certificate", &tls.ConnectionState{}, "", http.StatusUnauthorized, ""},
+		{"nothing", nil, "", http.StatusUnauthorized, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+		req.TLS = tc.tls
+		if tc.token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s: status %d: %s", tc.name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestClientCertIsRefusedOnAuthRoutes(t *testing.T) {
+	s := newTestServer(t)
+	s.clientCerts = &appmiddleware.ClientCertConfig{}
+	// Never reached: the routes refuse the certificate first
+	s.APIKeys = &apikey.Repository{}
+	s.configureJWTMiddleware()
+	h := s.MountAuth(testAuthenticator{}, AuthOptions{})
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+		Subject:      pkix.Name{CommonName: "billing"},
+		SerialNumber: big.NewInt(7),
+	}}}}
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/auth/api-keys"},
+		{http.MethodPost, "/auth/api-keys"},
+		{http.MethodDelete, "/auth/api-keys/1"},
+		{http.MethodGet, "/auth/me"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.TLS = verified
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: status %d, want 401", route.method, route.path, rec.Code)
+		}
+	}
+
+	// The MFA handlers refuse certificate claims should they get them
+	for name, handler := range map[string]echo.HandlerFunc{
+		"enroll":  h.EnrollMFA,
+		"confirm": h.ConfirmMFA,
+		"disable": h.DisableMFA,
+	} {
+		rec := httptest.NewRecorder()
+		c := s.Echo.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+		c.Set(appmiddleware.ClaimsContextKey, appmiddleware.DefaultCertIdentity(verified.VerifiedChains[0][0]))
+		if err := handler(c); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, rec.Code)
+		}
+	}
+}
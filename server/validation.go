@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenValidation controls how incoming access and refresh tokens are verified
+type TokenValidation struct {
+	// Issuer is required in the iss claim. Defaults to the JWT config's issuer.
+	Issuer string `yaml:"issuer"`
+	// Audience must appear in the aud claim. Defaults to the JWT config's audience.
+	Audience string `yaml:"audience"`
+	// Algorithms restricts the accepted alg header values. When empty any
+	// algorithm of a key in the key ring is accepted.
+	Algorithms []string `yaml:"algorithms"`
+	// Leeway tolerates clock skew when checking exp, nbf and iat
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+// parser builds a JWT parser that enforces the validation settings
+func (s *Server) parser() *jwt.Parser {
+	v := s.validation
+	opts := []jwt.ParserOption{
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.Leeway),
+	}
+	if v.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.Issuer))
+	}
+	if v.Audience != "" {
+		opts = append(opts, jwt.WithAudience(v.Audience))
+	}
+	if len(v.Algorithms) > 0 {
+		opts = append(opts, jwt.WithValidMethods(v.Algorithms))
+	}
+	return jwt.NewParser(opts...)
+}
+
+// parseToken verifies tokenString into claims
+func (s *Server) parseToken(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	// The key ring validates the signing method against the key's algorithm
+	token, err := s.parser().ParseWithClaims(tokenString, claims, s.Keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return token, nil
+}
+
+// parseAccessToken verifies an access token into the registered claims type
+func (s *Server) parseAccessToken(tokenString string) (*jwt.Token, error) {
+	claims := s.newClaims()
+	token, err := s.parseToken(tokenString, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch claims.Base().TokenType {
+	case appmiddleware.TokenTypeAccess:
+	case appmiddleware.TokenTypeMFAPending:
+		return nil, ErrMFARequired
+	default:
+		return nil, fmt.Errorf("invalid token type")
+	}
+	return token, nil
+}
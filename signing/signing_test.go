@@ -0,0 +1,166 @@
+package signing
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var testKey = Key{ID: "k1", Secret: "s3cret", Service: "billing"}
+
+func newTestVerifier(t *testing.T) *Verifier {
+	t.Helper()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	return NewVerifier(NewRedisNonceStore(rdb), VerifierConfig{MaxSkew: time.Minute}, testKey)
+}
+
+func signedRequest(t *testing.T, body string) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/invoices?draft=1", strings.NewReader(body))
+	if err := Sign(req, testKey); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return req
+}
+
+func TestSignAndVerify(t *testing.T) {
+	v := newTestVerifier(t)
+	req := signedRequest(t, `{"amount":100}`)
+
+	key, err := v.Verify(req)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if key.ID != testKey.ID {
+		t.Errorf("key = %q", key.ID)
+	}
+
+	// The body is still there for the handler
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"amount":100}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestVerifyRejectsTamperedRequests(t *testing.T) {
+	v := newTestVerifier(t)
+
+	for name, tamper := range map[string]func(req *http.Request){
+		"body": func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(`{"amount":1000000}`))
+		},
+		"body and content hash": func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(`{"amount":1000000}`))
+			req.Header.Set(HeaderContentHash, hashBody([]byte(`{"amount":1000000}`)))
+		},
+		"query": func(req *http.Request) {
+			req.URL.RawQuery = "draft=0"
+		},
+		"method": func(req *http.Request) {
+			req.Method = http.MethodPut
+		},
+		"key": func(req *http.Request) {
+			req.Header.Set(HeaderKeyID, "k2")
+		},
+	} {
+		req := signedRequest(t, `{"amount":100}`)
+		tamper(req)
+		if _, err := v.Verify(req); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: got %v, want ErrInvalidSignature", name, err)
+		}
+	}
+
+	if _, err := v.Verify(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("unsigned: got %v, want ErrMissingSignature", err)
+	}
+}
+
+func TestVerifyRejectsClockSkew(t *testing.T) {
+	v := newTestVerifier(t)
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		// Signed correctly, but at a time outside the allowed skew
+		req := httptest.NewRequest(http.MethodGet, "/api/invoices", nil)
+		timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		bodyHash := hashBody(nil)
+		req.Header.Set(HeaderKeyID, testKey.ID)
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderNonce, "n"+timestamp)
+		req.Header.Set(HeaderSignature, signature(testKey.Secret,
+			canonicalRequest(req.Method, requestTarget(req), bodyHash, timestamp, "n"+timestamp)))
+
+		if _, err := v.Verify(req); !errors.Is(err, ErrStaleRequest) {
+			t.Errorf("offset %s: got %v, want ErrStaleRequest", offset, err)
+		}
+	}
+}
+
+func TestVerifyRejectsReplayedNonce(t *testing.T) {
+	v := newTestVerifier(t)
+	req := signedRequest(t, "")
+
+	replay := req.Clone(req.Context())
+	if _, err := v.Verify(req); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, err := v.Verify(replay); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("replay: got %v, want ErrReplayedRequest", err)
+	}
+}
+
+// onceReader hides its type from http.NewRequest, which then sets no
+// GetBody
+type onceReader struct{ io.Reader }
+
+func TestTransportLeavesCallersRequestAlone(t *testing.T) {
+	v := newTestVerifier(t)
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer server.Close()
+	client := NewClient(testKey)
+
+	for name, body := range map[string]io.Reader{
+		"rewindable": strings.NewReader(`{"amount":100}`),
+		"stream":     onceReader{strings.NewReader(`{"amount":100}`)},
+	} {
+		received = ""
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/invoices", body)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		originalBody, hadGetBody, length := req.Body, req.GetBody != nil, req.ContentLength
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || received != `{"amount":100}` {
+			t.Errorf("%s: status %d, body %q", name, resp.StatusCode, received)
+		}
+
+		if req.Header.Get(HeaderSignature) != "" {
+			t.Errorf("%s: signature headers set on the caller's request", name)
+		}
+		if req.Body != originalBody || (req.GetBody != nil) != hadGetBody || req.ContentLength != length {
+			t.Errorf("%s: caller's request body was replaced", name)
+		}
+	}
+}
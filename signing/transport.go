@@ -0,0 +1,72 @@
+package signing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that signs every outgoing request
+type Transport struct {
+	// Key signs the requests. To rotate, deploy the new key to the
+	// verifiers first, then switch callers to it.
+	Key Key
+	// Base sends the signed requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// NewClient returns an http.Client whose requests are signed with key
+func NewClient(key Key) *http.Client {
+	return &http.Client{Transport: &Transport{Key: key}}
+}
+
+// RoundTrip signs a copy of req and sends it
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request, so the body is
+	// buffered into a clone, which is signed and sent instead
+	signed := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+		signed.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		signed.ContentLength = int64(len(body))
+	}
+
+	if err := Sign(signed, t.Key); err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(signed)
+}
+
+// bufferBody reads the body of req, from a fresh copy when GetBody
+// provides one. The caller's body is closed either way, as RoundTrip must.
+func bufferBody(req *http.Request) ([]byte, error) {
+	defer req.Body.Close()
+
+	src := req.Body
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		defer body.Close()
+		src = body
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,224 @@
+package signing
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/1827mk/app-server/logger"
+	appmiddleware "github.com/1827mk/app-server/middleware"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// KeyIDContextKey is where the middleware stores the ID of the key that
+// signed the request
+const KeyIDContextKey = "signing_key_id"
+
+// NonceStore remembers nonces so each signed request is accepted once
+type NonceStore interface {
+	// Remember records nonce for ttl and reports whether it was new
+	Remember(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// RedisNonceStore keeps nonces in Redis, shared by every instance
+type RedisNonceStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisNonceStore creates a nonce store on rdb
+func NewRedisNonceStore(rdb *redis.Client) *RedisNonceStore {
+	return &RedisNonceStore{rdb: rdb}
+}
+
+// Remember implements NonceStore
+func (s *RedisNonceStore) Remember(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	fresh, err := s.rdb.SetNX(ctx, fmt.Sprintf("signing_nonce:%s", nonce), 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record nonce: %w", err)
+	}
+	return fresh, nil
+}
+
+// VerifierConfig controls which signed requests are accepted
+type VerifierConfig struct {
+	// MaxSkew is how far a request timestamp may be from the server clock.
+	// Defaults to 5 minutes.
+	MaxSkew time.Duration `yaml:"maxSkew"`
+	// MaxBodyBytes limits the body read for hashing. Defaults to 10 MiB.
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+}
+
+// Verifier checks signed requests against a set of keys
+type Verifier struct {
+	mu     sync.RWMutex
+	keys   map[string]Key
+	nonces NonceStore
+	cfg    VerifierConfig
+}
+
+// NewVerifier creates a verifier accepting requests signed with any of keys
+func NewVerifier(nonces NonceStore, cfg VerifierConfig, keys ...Key) *Verifier {
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = 5 * time.Minute
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 10 << 20
+	}
+
+	v := &Verifier{nonces: nonces, cfg: cfg}
+	v.SetKeys(keys...)
+	return v
+}
+
+// SetKeys replaces the accepted keys. During a rotation, pass both the old
+// and the new key until every caller has switched.
+func (v *Verifier) SetKeys(keys ...Key) {
+	m := make(map[string]Key, len(keys))
+	for _, key := range keys {
+		m[key.ID] = key
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = m
+}
+
+// AddKey accepts another key
+func (v *Verifier) AddKey(key Key) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[key.ID] = key
+}
+
+// RemoveKey stops accepting the key with the given ID
+func (v *Verifier) RemoveKey(id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys, id)
+}
+
+func (v *Verifier) key(id string) (Key, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	key, ok := v.keys[id]
+	return key, ok
+}
+
+// Verify checks the signature, timestamp and nonce of req and returns the
+// key that signed it. The body is read and put back.
+func (v *Verifier) Verify(req *http.Request) (Key, error) {
+	keyID := req.Header.Get(HeaderKeyID)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	sig := req.Header.Get(HeaderSignature)
+	if keyID == "" && sig == "" {
+		return Key{}, ErrMissingSignature
+	}
+	if keyID == "" || timestamp == "" || nonce == "" || sig == "" {
+		return Key{}, ErrInvalidSignature
+	}
+
+	key, ok := v.key(keyID)
+	if !ok {
+		return Key{}, fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, keyID)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > v.cfg.MaxSkew || skew < -v.cfg.MaxSkew {
+		return Key{}, ErrStaleRequest
+	}
+
+	body, err := readBody(req, v.cfg.MaxBodyBytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	bodyHash := hashBody(body)
+	if claimed := req.Header.Get(HeaderContentHash); claimed != "" && claimed != bodyHash {
+		return Key{}, fmt.Errorf("%w: body hash mismatch", ErrInvalidSignature)
+	}
+
+	expected := signature(key.Secret,
+		canonicalRequest(req.Method, requestTarget(req), bodyHash, timestamp, nonce))
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return Key{}, ErrInvalidSignature
+	}
+
+	// Only remember nonces of genuine requests, so forged requests cannot
+	// burn them. A nonce must outlive the window its timestamp is valid in.
+	fresh, err := v.nonces.Remember(req.Context(), keyID+":"+nonce, 2*v.cfg.MaxSkew)
+	if err != nil {
+		return Key{}, err
+	}
+	if !fresh {
+		return Key{}, ErrReplayedRequest
+	}
+
+	return key, nil
+}
+
+// Middleware rejects requests that are not signed with a known key. The
+// key's service and permissions become the request's claims, so the
+// authorization middleware applies to service callers as well.
+func (v *Verifier) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, err := v.Verify(c.Request())
+			if err != nil {
+				return v.reject(c, err)
+			}
+
+			c.Set(KeyIDContextKey, key.ID)
+			c.Set(appmiddleware.ClaimsContextKey, &appmiddleware.JWTClaims{
+				Username:    key.Service,
+				Permissions: key.Permissions,
+				TokenType:   appmiddleware.TokenTypeService,
+			})
+			return next(c)
+		}
+	}
+}
+
+func (v *Verifier) reject(c echo.Context, err error) error {
+	var status int
+	var code, message string
+	switch {
+	case errors.Is(err, ErrMissingSignature), errors.Is(err, ErrInvalidSignature):
+		status, code, message = http.StatusUnauthorized, "invalid_signature", err.Error()
+	case errors.Is(err, ErrStaleRequest):
+		status, code, message = http.StatusUnauthorized, "stale_request", err.Error()
+	case errors.Is(err, ErrReplayedRequest):
+		status, code, message = http.StatusUnauthorized, "replayed_request", err.Error()
+	default:
+		logger.Logger().Error("Failed to verify request signature", logger.WithError(err))
+		status, code, message = http.StatusServiceUnavailable, "service_unavailable", "Signature verification is temporarily unavailable"
+	}
+
+	if status == http.StatusUnauthorized && !errors.Is(err, ErrMissingSignature) {
+		logger.SecurityEvent("request_signature_rejected",
+			zap.String("key_id", c.Request().Header.Get(HeaderKeyID)),
+			zap.String("ip", c.RealIP()),
+			zap.String("method", c.Request().Method),
+			zap.String("path", c.Request().URL.Path),
+			logger.WithError(err),
+		)
+	}
+
+	return c.JSON(status, logger.ErrorResponse{
+		Success: false,
+		Errors: []map[string]string{{
+			"code":    code,
+			"message": message,
+		}},
+		Message: http.StatusText(status),
+	})
+}